@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// captureVersion is written to every record so that older capture files can
+// still be read when the format changes.
+//
+//	1: bodies are recorded as sent over the wire
+//	2: bodies compressed with Content-Encoding are recorded decoded
+const captureVersion = 2
+
+// 1行(1フロー)の最大サイズ
+const maxCaptureLineSize = 1 << 30
+
+// CapturedFlow is one line of a capture file (JSON Lines).
+// Bodies are []byte and therefore encoded in base64.
+type CapturedFlow struct {
+	Version   int              `json:"version"`
+	ID        string           `json:"id"`
+	StartedAt time.Time        `json:"startedAt"`
+	Request   CapturedRequest  `json:"request"`
+	Response  CapturedResponse `json:"response"`
+	// nanoseconds
+	Wait    time.Duration `json:"wait,omitempty"`
+	Receive time.Duration `json:"receive,omitempty"`
+	// 外部APIとの通信に失敗した場合のエラーの種類
+	Error string `json:"error,omitempty"`
+	// WebSocketで送受信したメッセージ
+	Messages []WebSocketMessage `json:"messages,omitempty"`
+	// ストリーミングのレスポンスボディを受け取った単位
+	Chunks []BodyChunk `json:"chunks,omitempty"`
+}
+
+type CapturedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Host   string      `json:"host"`
+	Proto  string      `json:"proto,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	// Content-Encodingを展開できずに圧縮されたまま記録したボディか
+	Undecoded bool `json:"undecoded,omitempty"`
+}
+
+type CapturedResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Proto      string      `json:"proto,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Undecoded  bool        `json:"undecoded,omitempty"`
+}
+
+type CaptureWriter struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func NewCaptureWriter(path string) (*CaptureWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	return &CaptureWriter{
+		file: f,
+	}, nil
+}
+
+// 1フローを1行で書き込むのでプロセスが途中で落ちても書き込み済みのフローは残る
+func (c *CaptureWriter) write(flow Flow, reqBody, respBody []byte) error {
+	record := CapturedFlow{
+		Version:   captureVersion,
+		ID:        flow.ID,
+		StartedAt: flow.StartedAt,
+		Request: CapturedRequest{
+			Method:    flow.Request.Method,
+			Host:      flow.Request.Host,
+			Proto:     flow.Request.Proto,
+			Header:    flow.Request.Header,
+			Body:      reqBody,
+			Undecoded: flow.RequestUndecoded,
+		},
+		Response: CapturedResponse{
+			StatusCode: flow.Response.StatusCode,
+			Proto:      flow.Response.Proto,
+			Header:     flow.Response.Header,
+			Body:       respBody,
+			Undecoded:  flow.ResponseUndecoded,
+		},
+		Wait:     flow.Wait,
+		Receive:  flow.Receive,
+		Error:    flow.Error,
+		Messages: flow.Messages,
+		Chunks:   flow.Chunks,
+	}
+	if flow.Request.URL != nil {
+		record.Request.URL = flow.Request.URL.String()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal flow: %w", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write flow: %w", err)
+	}
+	return nil
+}
+
+func (c *CaptureWriter) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.file.Close()
+}
+
+// ReadCaptureFile reads flows written by CaptureWriter.
+func ReadCaptureFile(path string) (map[string]Flow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	defer f.Close()
+	flows := make(map[string]Flow)
+	scanner := bufio.NewScanner(f)
+	// ボディを含む行は長くなるのでバッファを大きく取る
+	scanner.Buffer(make([]byte, 0, 1024*1024), maxCaptureLineSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record CapturedFlow
+		if err := json.Unmarshal(line, &record); err != nil {
+			// 書き込み途中で落ちた行などは捨てて続きを読む
+			log.Warn().Err(err).Msgf("%s:%d: ignore broken record", path, n)
+			continue
+		}
+		flow, err := record.flow()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		flows[flow.ID] = flow
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read capture file %s: %w", path, err)
+	}
+	return flows, nil
+}
+
+func (c CapturedFlow) flow() (Flow, error) {
+	if c.Version > captureVersion {
+		return Flow{}, fmt.Errorf("unsupported capture version %d", c.Version)
+	}
+	u, err := url.Parse(c.Request.URL)
+	if err != nil {
+		return Flow{}, fmt.Errorf("failed to parse url of flow %s: %w", c.ID, err)
+	}
+	if c.Version < 2 {
+		// 圧縮されたまま記録されているので展開しないと再圧縮で二重になる
+		c.Request.Body, c.Request.Undecoded = decodeBody(c.Request.Header, c.Request.Body)
+		c.Response.Body, c.Response.Undecoded = decodeBody(c.Response.Header, c.Response.Body)
+	}
+	return Flow{
+		ID:        c.ID,
+		StartedAt: c.StartedAt,
+		Request: http.Request{
+			Method: c.Request.Method,
+			URL:    u,
+			Host:   c.Request.Host,
+			Proto:  c.Request.Proto,
+			Header: c.Request.Header,
+			Body:   io.NopCloser(bytes.NewReader(c.Request.Body)),
+		},
+		Response: http.Response{
+			StatusCode: c.Response.StatusCode,
+			Proto:      c.Response.Proto,
+			Header:     c.Response.Header,
+			Body:       io.NopCloser(bytes.NewReader(c.Response.Body)),
+		},
+		Wait:              c.Wait,
+		Receive:           c.Receive,
+		Error:             c.Error,
+		Messages:          c.Messages,
+		Chunks:            c.Chunks,
+		RequestUndecoded:  c.Request.Undecoded,
+		ResponseUndecoded: c.Response.Undecoded,
+	}, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	w, err := NewCaptureWriter(path)
+	assert.NoError(t, err)
+	u, _ := url.Parse("http://example.com:8080/api/foo?name=hoge")
+	flow := Flow{
+		ID:        "1",
+		StartedAt: time.Date(2022, time.August, 1, 0, 0, 0, 0, time.UTC),
+		Request: http.Request{
+			Method: "POST",
+			URL:    u,
+			Host:   "example.com:8080",
+		},
+		Response: http.Response{
+			StatusCode: 201,
+			Header: http.Header{
+				"X-Foo": []string{"bar"},
+			},
+		},
+	}
+	assert.NoError(t, w.write(flow, []byte(`{"token":"abc"}`), []byte{0x00, 0xff, 0x10}))
+	assert.NoError(t, w.Close())
+
+	// 書き込み途中で落ちた行は読み飛ばす
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"version":1,"id":"2","request":{"meth`)
+	assert.NoError(t, err)
+	f.Close()
+
+	flows, err := ReadCaptureFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(flows))
+	got := flows["1"]
+	assert.Equal(t, "POST", got.Request.Method)
+	assert.Equal(t, u.String(), got.Request.URL.String())
+	assert.Equal(t, "example.com:8080", got.Request.Host)
+	assert.Equal(t, 201, got.Response.StatusCode)
+	assert.Equal(t, "bar", got.Response.Header.Get("X-Foo"))
+	assert.True(t, flow.StartedAt.Equal(got.StartedAt))
+	reqBody, _ := io.ReadAll(got.Request.Body)
+	assert.Equal(t, `{"token":"abc"}`, string(reqBody))
+	respBody, _ := io.ReadAll(got.Response.Body)
+	assert.True(t, bytes.Equal([]byte{0x00, 0xff, 0x10}, respBody))
+}
+
+func TestCaptureBrokenLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	lines := []string{
+		`{"version":2,"id":"1","request":{"method":"GET","url":"http://example.com/a"},"response":{"statusCode":200}}`,
+		`{"version":2,"id":"2","request":{"meth`,
+		``,
+		`{"version":2,"id":"3","request":{"method":"GET","url":"http://example.com/c"},"response":{"statusCode":201}}`,
+	}
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+	// 壊れた行を読み飛ばしてその後の行も読む
+	flows, err := ReadCaptureFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(flows))
+	assert.Equal(t, 201, flows["3"].Response.StatusCode)
+}
+
+func TestCaptureLongLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	w, err := NewCaptureWriter(path)
+	assert.NoError(t, err)
+	u, _ := url.Parse("http://example.com/large")
+	flow := Flow{
+		ID:       "1",
+		Request:  http.Request{Method: "GET", URL: u, Host: "example.com"},
+		Response: http.Response{StatusCode: 200},
+	}
+	// bufio.Scannerのデフォルトの上限(64KB)より長い行
+	large := bytes.Repeat([]byte("a"), 1024*1024)
+	assert.NoError(t, w.write(flow, nil, large))
+	assert.NoError(t, w.Close())
+
+	flows, err := ReadCaptureFile(path)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(flows["1"].Response.Body)
+	assert.Equal(t, len(large), len(body))
+}
+
+func TestCaptureUnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":999,"id":"1","request":{"url":"/"}}`+"\n"), 0644))
+	_, err := ReadCaptureFile(path)
+	assert.Error(t, err)
+}
+
+func TestCaptureVersion1CompressedBody(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`{"id":1}`))
+	w.Close()
+	record := CapturedFlow{
+		Version: 1,
+		ID:      "1",
+		Request: CapturedRequest{Method: "GET", URL: "http://example.com/users/1", Host: "example.com"},
+		Response: CapturedResponse{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+			Body:       gz.Bytes(),
+		},
+	}
+	line, err := json.Marshal(record)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	assert.NoError(t, os.WriteFile(path, append(line, '\n'), 0644))
+
+	flows, err := ReadCaptureFile(path)
+	assert.NoError(t, err)
+	// バージョン1は圧縮されたまま記録されているので読み込むときに展開する
+	body, _ := io.ReadAll(flows["1"].Response.Body)
+	assert.Equal(t, `{"id":1}`, string(body))
+	assert.Equal(t, "gzip", flows["1"].Response.Header.Get("Content-Encoding"))
+}
+
+func TestCaptureUndecodedBody(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	w, err := NewCaptureWriter(path)
+	assert.NoError(t, err)
+	u, _ := url.Parse("http://example.com/broken")
+	flow := Flow{
+		ID:                "1",
+		Request:           http.Request{Method: "GET", URL: u, Host: "example.com"},
+		Response:          http.Response{StatusCode: 200, Header: http.Header{"Content-Encoding": []string{"gzip"}}},
+		ResponseUndecoded: true,
+	}
+	assert.NoError(t, w.write(flow, nil, []byte("broken")))
+	assert.NoError(t, w.Close())
+	// バージョン1の展開できないボディも圧縮されたままとして読む
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"version":1,"id":"2","request":{"method":"GET","url":"http://example.com/broken"},"response":{"statusCode":200,"header":{"Content-Encoding":["gzip"]},"body":"YnJva2Vu"}}` + "\n")
+	assert.NoError(t, err)
+	f.Close()
+
+	flows, err := ReadCaptureFile(path)
+	assert.NoError(t, err)
+	for _, id := range []string{"1", "2"} {
+		assert.True(t, flows[id].ResponseUndecoded, id)
+		assert.False(t, flows[id].RequestUndecoded, id)
+		assert.Equal(t, http.Header{"Content-Encoding": []string{"gzip"}}, flows[id].Response.Header, id)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/jennifer/jen"
+)
+
+// ルートごとにマッチしなかったリクエストに返すレスポンス
+type fallbackResponse struct {
+	StatusCode int
+	Body       string
+}
+
+func isFallbackMode(mode string) bool {
+	switch mode {
+	case "none", "404", "501", "nearest", "proxy":
+		return true
+	}
+	return false
+}
+
+// "GET /users/{id}=404:{\"error\":\"not found\"}"のような指定を"<メソッド> <パス>"をキーにしたレスポンスにする
+// メソッドの"*"は全てのメソッドにマッチする
+func parseFallbackResponses(values []string) (map[string]fallbackResponse, error) {
+	responses := make(map[string]fallbackResponse)
+	for _, value := range values {
+		route, response, found := strings.Cut(value, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid fallback response %q: must be <method> <path>=<status>[:<body>]", value)
+		}
+		method, path, found := strings.Cut(route, " ")
+		if !found || method == "" || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid fallback response %q: route must be <method> <path>", value)
+		}
+		status, body, _ := strings.Cut(response, ":")
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid fallback response %q: invalid status code %q", value, status)
+		}
+		responses[strings.ToUpper(method)+" "+path] = fallbackResponse{StatusCode: code, Body: body}
+	}
+	return responses, nil
+}
+
+// どのリクエストにもマッチしなかったときにルートのレスポンスを返し、それもなければ-fallbackに従う
+func (h *Path) renderFallback(mux string) []jen.Code {
+	var codes []jen.Code
+	var methods []string
+	for route := range fallbackResponses {
+		if method, path, _ := strings.Cut(route, " "); path == h.value() {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	// "*"は全てのメソッドにマッチするので最後に置く
+	if len(methods) > 0 && methods[0] == "*" {
+		methods = append(methods[1:], "*")
+	}
+	for _, method := range methods {
+		res := fallbackResponses[method+" "+h.value()]
+		write := []jen.Code{jen.Id("rw").Dot("WriteHeader").Call(jen.Lit(res.StatusCode))}
+		if res.Body != "" {
+			write = append(write, jen.Qual("fmt", "Fprint").Call(jen.Id("rw"), bodyString(res.Body)))
+		}
+		write = append(write, jen.Return())
+		if method == "*" {
+			return append(codes, write...)
+		}
+		codes = append(codes, jen.If(jen.Id("r").Dot("Method").Op("==").Lit(method)).Block(write...))
+	}
+	if fallbackMode == "none" {
+		return codes
+	}
+	useFallback()
+	return append(codes, jen.Id("fallback").Call(jen.Id("rw"), jen.Id("r"), jen.Id(mux), jen.Id("upstream"), jen.Id("body"), jen.Index().Id("fallbackCandidate").Values(h.candidates()...)))
+}
+
+func (h *Path) candidates() []jen.Code {
+	var candidates []jen.Code
+	for _, key := range sortedKeys(h.Children) {
+		candidates = append(candidates, fallbackCandidates(h.Children[key], map[string]string{"Path": h.value()})...)
+	}
+	return candidates
+}
+
+func useFallback() {
+	modes := "none(empty 200), 404 or 501(with the closest recorded requests) or nearest(the response of the closest recorded request)"
+	if fallbackMode == "proxy" {
+		// 外部APIへの転送と記録は-fallback proxyで生成したときだけ使える
+		modes = "none(empty 200), 404 or 501(with the closest recorded requests), nearest(the response of the closest recorded request) or proxy(the response of the upstream)"
+		useFlag("capture", jen.Id("captureFile").Op("=").Qual("flag", "String").Call(jen.Lit("capture"), jen.Lit(""), jen.Lit("capture file path to append flows proxied by -fallback proxy, which can be passed to gstbgen generate --from")))
+	}
+	useFlag("fallback", jen.Id("fallbackMode").Op("=").Qual("flag", "String").Call(jen.Lit("fallback"), jen.Lit(fallbackMode), jen.Lit("how to respond to requests matching no recorded request: "+modes)))
+}
+
+// 記録されていないパスのリクエストもホストの全てのリクエストを候補として-fallbackに従う
+func (h *Host) renderCatchAll(mux string) []jen.Code {
+	if fallbackMode == "none" {
+		return nil
+	}
+	if _, found := h.Children["/"]; found {
+		// "/"は全てのパスにマッチするので記録されたハンドラでフォールバックする
+		return nil
+	}
+	useFallback()
+	var candidates []jen.Code
+	for _, key := range sortedKeys(h.Children) {
+		if path, ok := h.Children[key].(*Path); ok {
+			candidates = append(candidates, path.candidates()...)
+		}
+	}
+	codes := readRequestBody()
+	codes = append(codes, jen.Id("fallback").Call(jen.Id("rw"), jen.Id("r"), jen.Id(mux), jen.Id("upstream"), jen.Id("body"), jen.Index().Id("fallbackCandidate").Values(candidates...)))
+	return []jen.Code{
+		jen.Id("mux").Dot("HandleFunc").Call(jen.Lit("/"), jen.Func().Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Op("*").Qual("net/http", "Request")).Block(
+			codes...,
+		)),
+	}
+}
+
+// 記録されたリクエストをハンドラで比較する形で列挙する
+func fallbackCandidates(node SyntaxNode, fields map[string]string) []jen.Code {
+	candidate := make(map[string]string)
+	for k, v := range fields {
+		candidate[k] = v
+	}
+	switch node.(type) {
+	case *PathValue:
+		candidate["Path"] = node.value()
+	case *Method:
+		candidate["Method"] = node.value()
+	case *QueryParameter:
+		candidate["Query"] = node.value()
+	case *RequestHeader:
+		candidate["Header"] = node.value()
+	case *ReqBody:
+		values := jen.Dict{jen.Id("Body"): bodyString(node.value())}
+		for k, v := range candidate {
+			values[jen.Id(k)] = jen.Lit(v)
+		}
+		return []jen.Code{jen.Values(values)}
+	default:
+		return nil
+	}
+	var codes []jen.Code
+	for _, key := range sortedKeys(node.children()) {
+		codes = append(codes, fallbackCandidates(node.children()[key], candidate)...)
+	}
+	return codes
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFallbackResponses(t *testing.T) {
+	responses, err := parseFallbackResponses([]string{`get /users/{id}=404:{"error":"not found"}`, `* /orders=501`})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]fallbackResponse{
+		"GET /users/{id}": {StatusCode: 404, Body: `{"error":"not found"}`},
+		"* /orders":       {StatusCode: 501},
+	}, responses)
+
+	for _, invalid := range []string{"GET /users", "/users=404", "GET users=404", "GET /users=ok", "GET /users=999"} {
+		_, err := parseFallbackResponses([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestGenerateFallback(t *testing.T) {
+	resetGenerator()
+	fallbackMode = "nearest"
+	fallbackResponses = map[string]fallbackResponse{
+		"DELETE /orders": {StatusCode: 405, Body: "not allowed"},
+	}
+	defer func() {
+		fallbackMode = "none"
+		fallbackResponses = nil
+		// generator_test.goのテストは初期状態のツリーを前提にしている
+		resetGenerator()
+	}()
+	flows := map[string]Flow{}
+	for i := 0; i < 2; i++ {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/orders"},
+				Body:   io.NopCloser(bytes.NewReader([]byte(`{"item":` + id + `}`))),
+			},
+			Response: http.Response{
+				StatusCode: 201,
+				Body:       io.NopCloser(bytes.NewReader([]byte("order" + id))),
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `fallbackMode = flag.String("fallback", "nearest",`)
+	// 最も近いリクエストとして再度渡されたときは記録されたボディで比較する
+	assert.Contains(t, code, `if c, ok := r.Context().Value(fallbackKey{}).(fallbackCandidate); ok {
+				body = c.Body
+			}`)
+	// ルートのレスポンスを-fallbackより先に返す
+	assert.Contains(t, code, `			if r.Method == "DELETE" {
+				rw.WriteHeader(405)
+				fmt.Fprint(rw, "not allowed")
+				return
+			}
+			fallback(rw, r, mux, upstream, body, []fallbackCandidate{{
+				Body:   "{\"item\":0}",
+				Method: "POST",
+				Path:   "/orders",
+				Query:  "{}",
+			}, {
+				Body:   "{\"item\":1}",`)
+	assert.Contains(t, code, `func fallback(rw http.ResponseWriter, r *http.Request, handler http.Handler, upstream string, body string, candidates []fallbackCandidate) {`)
+	// 外部APIへの転送は-fallback proxyで生成したときだけ
+	assert.NotContains(t, code, `case "proxy":`)
+	assert.NotContains(t, code, `func proxyUpstream(`)
+	assert.NotContains(t, code, `flag.String("capture",`)
+}
+
+func TestGenerateFallbackProxy(t *testing.T) {
+	resetGenerator()
+	fallbackMode = "proxy"
+	defer func() {
+		fallbackMode = "none"
+		resetGenerator()
+	}()
+	flows := map[string]Flow{
+		"0": {
+			ID: "0",
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/known"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `upstream := "http://localhost:8080"`)
+	assert.Contains(t, code, `keepBody(r)
+			body, _ := stringify(r.Body)`)
+	// 記録されていないパスも外部APIに転送する
+	assert.Contains(t, code, `mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {`)
+	// 記録されていないパスでもホストの全てのリクエストが候補になる
+	assert.Contains(t, code, `			fallback(rw, r, mux, upstream, body, []fallbackCandidate{{
+				Body:   "",
+				Method: "GET",
+				Path:   "/known",
+				Query:  "{}",
+			}})
+		})
+		port := `)
+	assert.Contains(t, code, `flag.String("capture", "",`)
+	assert.Contains(t, code, `case "proxy":
+		proxyUpstream(rw, r, upstream)`)
+	assert.Contains(t, code, `res, err := http.DefaultTransport.RoundTrip(req)`)
+	// hop-by-hopヘッダーは転送しない
+	assert.Contains(t, code, `req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)`)
+	assert.Contains(t, code, `removeHopHeaders(res.Header)
+	for k, vv := range res.Header {`)
+	assert.Contains(t, code, `func removeHopHeaders(h http.Header) {`)
+	assert.Contains(t, code, `flow.Version = 2`)
+}
+
+func TestStubFallbackUnrecordedPath(t *testing.T) {
+	resetGenerator()
+	fallbackMode = "nearest"
+	defer func() {
+		fallbackMode = "none"
+		resetGenerator()
+	}()
+	flows := map[string]Flow{
+		"0": {
+			ID: "0",
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/users"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte("users"))),
+			},
+		},
+	}
+	base := runStub(t, flows)
+	// 記録されていないパスには最も近い記録されたリクエストのレスポンスを返す
+	status, body := stubGet(t, base+"/orders")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "users", body)
+
+	base = runStub(t, flows, "-fallback", "404")
+	status, body = stubGet(t, base+"/orders")
+	assert.Equal(t, 404, status)
+	assert.JSONEq(t, `{
+		"error": "no recorded request matched",
+		"request": {"method": "GET", "path": "/orders", "query": "{}", "body": ""},
+		"candidates": [{"method": "GET", "path": "/users", "query": "{}", "body": "", "score": 8.714285714285715}]
+	}`, body)
+}
+
+func TestStubFallbackProxy(t *testing.T) {
+	resetGenerator()
+	fallbackMode = "proxy"
+	defer func() {
+		fallbackMode = "none"
+		resetGenerator()
+	}()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "%s hop=%q keep=%q", r.URL.Path, r.Header.Get("X-Hop"), r.Header.Get("X-Keep"))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	flows := map[string]Flow{
+		"0": {
+			ID: "0",
+			Request: http.Request{
+				Method: "GET",
+				Host:   u.Host,
+				URL:    &url.URL{Scheme: "http", Path: "/known"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte("known"))),
+			},
+		},
+	}
+	capture := filepath.Join(t.TempDir(), "capture.jsonl")
+	base := runStub(t, flows, "-capture", capture)
+
+	req, _ := http.NewRequest("GET", base+"/unknown", nil)
+	// Connectionに列挙されたヘッダーもhop-by-hopとして転送しない
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Keep", "1")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, `/unknown hop="" keep="1"`, string(body))
+
+	captured, err := ReadCaptureFile(capture)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(captured))
+	for _, flow := range captured {
+		assert.Equal(t, "/unknown", flow.Request.URL.Path)
+	}
+}
@@ -2,15 +2,124 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/rs/zerolog/log"
 )
 
 type Flow struct {
-	ID       string
-	Request  http.Request
-	Response http.Response
+	ID        string
+	StartedAt time.Time
+	Request   http.Request
+	Response  http.Response
+	// リクエスト開始からレスポンスヘッダを受け取るまでの時間
+	Wait time.Duration
+	// レスポンスヘッダを受け取ってからボディを読み終わるまでの時間
+	Receive time.Duration
+	// 外部APIとの通信に失敗した場合のエラーの種類(upstreamError*)
+	Error string
+	// WebSocketにアップグレードした場合に送受信したメッセージ
+	Messages []WebSocketMessage
+	// ストリーミングのレスポンスボディを受け取った単位(連結するとボディになる)
+	Chunks []BodyChunk
+	// Content-Encodingを展開できずに圧縮されたまま記録したボディか
+	RequestUndecoded  bool
+	ResponseUndecoded bool
+}
+
+// BodyChunk is a part of a streaming response body received at once.
+type BodyChunk struct {
+	// フローの開始からの経過時間
+	At   time.Duration `json:"at"`
+	Size int           `json:"size"`
+}
+
+// この間隔より短く届いたデータは1つのチャンクとみなす
+const chunkMergeWindow = 10 * time.Millisecond
+
+// SSEや長さが不明(chunked)なレスポンスはストリーミングとして扱う
+func isStreamingResponse(r *http.Response) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "text/event-stream") || r.ContentLength < 0
+}
+
+// レスポンスボディが読まれるたびに受け取った時刻とサイズを記録する
+type chunkRecorder struct {
+	io.ReadCloser
+	startedAt time.Time
+	chunks    []BodyChunk
+}
+
+func (c *chunkRecorder) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		at := time.Since(c.startedAt)
+		if last := len(c.chunks) - 1; last >= 0 && at-c.chunks[last].At < chunkMergeWindow {
+			c.chunks[last].Size += n
+		} else {
+			c.chunks = append(c.chunks, BodyChunk{At: at, Size: n})
+		}
+	}
+	return n, err
+}
+
+// 一度に届いたボディはストリーミングとして再現する必要がない
+func (c *chunkRecorder) result() []BodyChunk {
+	if len(c.chunks) <= 1 {
+		return nil
+	}
+	return c.chunks
+}
+
+// Duration returns the total duration of the flow.
+func (f Flow) Duration() time.Duration {
+	return f.Wait + f.Receive
+}
+
+// 外部APIとの通信に失敗したときのエラーの種類
+const (
+	upstreamErrorDNS     = "dns"
+	upstreamErrorRefused = "refused"
+	upstreamErrorTimeout = "timeout"
+	upstreamErrorTLS     = "tls"
+	upstreamErrorOther   = "error"
+)
+
+func classifyUpstreamError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return upstreamErrorDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return upstreamErrorRefused
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return upstreamErrorTimeout
+	}
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) || strings.Contains(err.Error(), "tls:") {
+		return upstreamErrorTLS
+	}
+	return upstreamErrorOther
 }
 
 type Flowsx struct {
@@ -24,6 +133,21 @@ func (f *Flowsx) add(flow Flow) {
 	f.Flows[flow.ID] = flow
 }
 
+// 開始時刻順(同時刻ならID順)に並べる
+func sortedFlows(flows map[string]Flow) []Flow {
+	sorted := make([]Flow, 0, len(flows))
+	for _, flow := range flows {
+		sorted = append(sorted, flow)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].StartedAt.Equal(sorted[j].StartedAt) {
+			return sorted[i].StartedAt.Before(sorted[j].StartedAt)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
 func duplicateReadCloser(rc io.ReadCloser) (original io.ReadCloser, duplicated io.ReadCloser) {
 	var b bytes.Buffer
 	original = teeReadCloser(rc, &b)
@@ -50,3 +174,107 @@ func (body Body) Close() error {
 func (body Body) Read(p []byte) (n int, err error) {
 	return body.b.Read(p)
 }
+
+// bodyの読み込みが終わった(Closeされた)タイミングでfを一度だけ呼ぶ
+func notifyOnClose(rc io.ReadCloser, f func()) io.ReadCloser {
+	return &closeNotifier{
+		ReadCloser: rc,
+		f:          f,
+	}
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	f    func()
+	once sync.Once
+}
+
+func (c *closeNotifier) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.f)
+	return err
+}
+
+// bodyを読み出し、もう一度読めるように差し替える
+func peekBody(rc *io.ReadCloser) []byte {
+	b := readAllBody(*rc)
+	*rc = io.NopCloser(bytes.NewReader(b))
+	return b
+}
+
+func readAllBody(rc io.ReadCloser) []byte {
+	if rc == nil {
+		return nil
+	}
+	b, _ := io.ReadAll(rc)
+	return b
+}
+
+// Content-Encodingに従って圧縮されたボディを展開する
+// 複数指定されている場合は適用された順の逆に展開する
+func decodeContentEncoding(encoding string, body []byte) ([]byte, error) {
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// zlib形式が正しいが生のdeflateを返すサーバーもある
+			if r, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		default:
+			return body, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		if err != nil {
+			return body, err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return body, err
+		}
+	}
+	return body, nil
+}
+
+// 展開できるContent-Encodingか
+func isDecodableEncoding(encoding string) bool {
+	for _, coding := range strings.Split(encoding, ",") {
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "", "identity", "gzip", "x-gzip", "deflate", "br":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Content-Encodingにbrが含まれるか
+func isBrotliEncoding(encoding string) bool {
+	for _, coding := range strings.Split(encoding, ",") {
+		if strings.ToLower(strings.TrimSpace(coding)) == "br" {
+			return true
+		}
+	}
+	return false
+}
+
+// 記録するボディは展開しておく
+// 展開できない場合はそのまま返し、スタブが圧縮し直さないようにundecodedをtrueにする
+func decodeBody(header http.Header, body []byte) (decoded []byte, undecoded bool) {
+	encoding := header.Get("Content-Encoding")
+	if encoding == "" || len(body) == 0 {
+		return body, false
+	}
+	decoded, err := decodeContentEncoding(encoding, body)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to decode body, recorded as is")
+		return body, true
+	}
+	return decoded, false
+}
@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/dave/jennifer/jen"
 	"github.com/rs/zerolog/log"
 )
 
 func createExternalAPITree(flows map[string]Flow) (SyntaxNode, error) {
-	for _, flow := range flows {
+	resetTree()
+	// 同じリクエストに対するレスポンスを記録された順に再生できるように時系列順に処理する
+	for _, flow := range sortedFlows(flows) {
 		var hostString string
 		hostport := strings.Split(flow.Request.Host, ":")
 		if len(hostport) == 1 {
@@ -29,24 +40,57 @@ func createExternalAPITree(flows map[string]Flow) (SyntaxNode, error) {
 			hostString = fmt.Sprintf("%s://%s", flow.Request.URL.Scheme, flow.Request.Host)
 		}
 
-		queryString, err := stringifyUrlValues(flow.Request.URL.Query())
+		if strings.HasPrefix(flow.Response.Proto, "HTTP/2") {
+			state.http2Hosts[hostString] = true
+		}
+
+		query := flow.Request.URL.Query()
+		for _, key := range ignoreQueries {
+			query.Del(key)
+		}
+		queryString, err := stringifyUrlValues(query)
 		if err != nil {
 			// 失敗しても最低限のコード生成は可能なので続行する
 			log.Error().Err(err)
 		}
 
+		// ボディは記録時に展開されている
+		// 展開できなかったボディは圧縮されたまま比較する
+		if encoding := flow.Request.Header.Get("Content-Encoding"); !flow.RequestUndecoded && encoding != "" && isDecodableEncoding(encoding) {
+			state.decodeRequests = true
+			state.brotli = state.brotli || isBrotliEncoding(encoding)
+		}
 		reqBodyString, err := stringify(flow.Request.Body)
 		if err != nil {
 			// 失敗しても最低限のコード生成は可能なので続行する
 			log.Error().Err(err)
 		}
+		rawReqBody := reqBodyString
+		if form, ok := normalizeForm(flow.Request.Header.Get("Content-Type"), reqBodyString); ok {
+			reqBodyString = form
+			state.formRequests = true
+		}
+		if x, ok := normalizeXML(flow.Request.Header, reqBodyString); ok {
+			reqBodyString = x
+			state.xmlRequests = true
+		}
+		reqBodyString = ignoreJSONFields(reqBodyString)
 
-		respBodyString, err := stringify(flow.Response.Body)
-		if err != nil {
-			// 失敗しても最低限のコード生成は可能なので続行する
-			log.Error().Err(err)
+		var stream []streamChunk
+		if len(flow.Chunks) > 0 {
+			stream = splitStream(peekBody(&flow.Response.Body), flow.Chunks, flow.Wait)
 		}
 
+		// 返すレスポンスは記録されたまま変えない
+		respBodyString := string(readAllBody(flow.Response.Body))
+
+		var encoding string
+		// 展開できなかったボディは圧縮し直さず、記録されたContent-Encodingと一緒にそのまま返す
+		if e := flow.Response.Header.Get("Content-Encoding"); !flow.ResponseUndecoded && e != "" && isDecodableEncoding(e) {
+			encoding = e
+			state.brotli = state.brotli || isBrotliEncoding(e)
+			flow.Response.Header.Del("Content-Encoding")
+		}
 		delete(flow.Response.Header, "Date")
 		delete(flow.Response.Header, "Content-Type")
 		delete(flow.Response.Header, "Content-Length")
@@ -56,7 +100,7 @@ func createExternalAPITree(flows map[string]Flow) (SyntaxNode, error) {
 		delete(flow.Response.Header, "Cache-Control")
 		delete(flow.Response.Header, "Expires")
 
-		var host, path, method, qs, req, res SyntaxNode
+		var host, path, pathValue, method, qs, header, req, res SyntaxNode
 		var found bool
 		if host, found = root.children()[hostString]; !found {
 			host = &Host{
@@ -65,19 +109,35 @@ func createExternalAPITree(flows map[string]Flow) (SyntaxNode, error) {
 			}
 			root.addChild(host)
 		}
-		if path, found = host.children()[flow.Request.URL.Path]; !found {
+		template := templatePath(flow.Request.URL.Path)
+		if isTemplatePath(flow.Request.URL.Path) {
+			// 既にテンプレートのパスは任意の値にマッチさせる
+			template = flow.Request.URL.Path
+		}
+		if path, found = host.children()[template]; !found {
 			path = &Path{
-				Value:    flow.Request.URL.Path,
+				Value:    template,
 				Children: make(map[string]SyntaxNode),
 			}
 			host.addChild(path)
 		}
-		if method, found = path.children()[flow.Request.Method]; !found {
+		// テンプレートにした場合も記録された値のパスのレスポンスを優先して返す
+		pathValue = path
+		if template != flow.Request.URL.Path {
+			if pathValue, found = path.children()[flow.Request.URL.Path]; !found {
+				pathValue = &PathValue{
+					Value:    flow.Request.URL.Path,
+					Children: make(map[string]SyntaxNode),
+				}
+				path.addChild(pathValue)
+			}
+		}
+		if method, found = pathValue.children()[flow.Request.Method]; !found {
 			method = &Method{
 				Value:    flow.Request.Method,
 				Children: make(map[string]SyntaxNode),
 			}
-			path.addChild(method)
+			pathValue.addChild(method)
 		}
 		if qs, found = method.children()[queryString]; !found {
 			qs = &QueryParameter{
@@ -86,25 +146,102 @@ func createExternalAPITree(flows map[string]Flow) (SyntaxNode, error) {
 			}
 			method.addChild(qs)
 		}
-		if req, found = qs.children()[reqBodyString]; !found {
+		parent := qs
+		if len(matchHeaders) > 0 {
+			headerString, err := stringifySelectedHeader(flow.Request.Header, matchHeaders)
+			if err != nil {
+				// 失敗しても最低限のコード生成は可能なので続行する
+				log.Error().Err(err)
+			}
+			if header, found = qs.children()[headerString]; !found {
+				header = &RequestHeader{
+					Value:    headerString,
+					Children: make(map[string]SyntaxNode),
+				}
+				qs.addChild(header)
+			}
+			parent = header
+		}
+		if req, found = parent.children()[reqBodyString]; !found {
 			req = &ReqBody{
-				Value:    reqBodyString,
-				Children: make(map[string]SyntaxNode),
+				Value:       reqBodyString,
+				Children:    make(map[string]SyntaxNode),
+				Body:        rawReqBody,
+				ContentType: flow.Request.Header.Get("Content-Type"),
 			}
-			qs.addChild(req)
+			parent.addChild(req)
 		}
 
+		route := fmt.Sprintf("%s %s%s", flow.Request.Method, hostString, template)
+		latency := flow.Duration()
+		if len(stream) > 0 {
+			// ストリーミングはチャンクの間隔で再現するので最初のレスポンスまでの時間だけ待つ
+			latency = flow.Wait
+		}
+		// WebSocketは接続していた時間になるので除く
+		if flow.Error == "" && latency > 0 && flow.Response.StatusCode != http.StatusSwitchingProtocols {
+			state.routeLatencies[route] = append(state.routeLatencies[route], latency)
+		}
 		res = &RespBody{
 			Value:      respBodyString,
 			StatusCode: flow.Response.StatusCode,
 			Header:     flow.Response.Header,
+			Error:      flow.Error,
+			Route:      route,
+			Latency:    latency,
+			Messages:   flow.Messages,
+			Stream:     stream,
+			Encoding:   encoding,
 		}
 		req.addChild(res)
 	}
 	return root, nil
 }
 
-// JSONに変換できるものはJSON文字列にする
+// 記録されたチャンクのサイズでボディを分割し、前のチャンクからの間隔を求める
+// ヘッダはwaitの時点で返しているので最初のチャンクはそこからの間隔になる
+func splitStream(body []byte, chunks []BodyChunk, wait time.Duration) []streamChunk {
+	stream := make([]streamChunk, 0, len(chunks))
+	prev := wait
+	offset := 0
+	for _, c := range chunks {
+		if offset >= len(body) {
+			break
+		}
+		end := offset + c.Size
+		if end > len(body) {
+			end = len(body)
+		}
+		delay := c.At - prev
+		if delay < 0 {
+			delay = 0
+		}
+		stream = append(stream, streamChunk{Delay: delay, Data: string(body[offset:end])})
+		prev = c.At
+		offset = end
+	}
+	// サイズが合わない場合は残りを最後のチャンクに含める
+	if offset < len(body) && len(stream) > 0 {
+		stream[len(stream)-1].Data += string(body[offset:])
+	}
+	return stream
+}
+
+// 画像やprotobufなどのテキストでないボディか
+func isBinaryBody(body string) bool {
+	if !utf8.ValidString(body) {
+		return true
+	}
+	for _, r := range body {
+		// 改行やタブ以外の制御文字を含むものはテキストとみなさない
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONに変換できるものは正規化したJSON文字列にする
 // できないものはそのまま文字列にして返す
 func stringify(r io.ReadCloser) (string, error) {
 	if r == nil {
@@ -115,15 +252,72 @@ func stringify(r io.ReadCloser) (string, error) {
 		return "", err
 	}
 	defer r.Close()
-	bm := make(map[string]interface{})
-	if err := json.Unmarshal(body, &bm); err != nil {
+	return canonicalJSON(body)
+}
+
+// キーの順序や空白に依らず同じJSONは同じ文字列にする
+// 数値はfloat64にすると2^53を超える整数が変わってしまうのでjson.Numberのまま扱う
+func canonicalJSON(body []byte) (string, error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
 		return string(body), err
 	}
-	if j, err := json.Marshal(bm); err != nil {
+	if _, err := d.Token(); err != io.EOF {
+		return string(body), fmt.Errorf("invalid JSON: unexpected data after top-level value")
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
 		return string(body), err
-	} else {
-		return string(j), nil
 	}
+	return string(j), nil
+}
+
+// フォームのボディはフィールドの順序やmultipartのboundaryに依らないJSON文字列にする
+// ファイルは内容のハッシュで比較する
+func normalizeForm(contentType, body string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return body, false
+	}
+	form := make(map[string][]string)
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(body)
+		if err != nil {
+			return body, false
+		}
+		form = values
+	case "multipart/form-data":
+		mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return body, false
+			}
+			b, err := io.ReadAll(part)
+			if err != nil {
+				return body, false
+			}
+			value := string(b)
+			if part.FileName() != "" {
+				sum := sha256.Sum256(b)
+				value = "sha256:" + hex.EncodeToString(sum[:])
+			}
+			form[part.FormName()] = append(form[part.FormName()], value)
+		}
+	default:
+		return body, false
+	}
+	j, err := json.Marshal(form)
+	if err != nil {
+		return body, false
+	}
+	return string(j), true
 }
 
 func stringifyUrlValues(m url.Values) (string, error) {
@@ -134,6 +328,31 @@ func stringifyUrlValues(m url.Values) (string, error) {
 	return string(query), nil
 }
 
+// namesで指定したヘッダのみをJSON文字列にする
+// "*"は全てのヘッダを表し、ignoreHeadersのヘッダは除く
+func stringifySelectedHeader(h http.Header, names []string) (string, error) {
+	selected := make(map[string][]string)
+	for _, name := range names {
+		if name == "*" {
+			for k, v := range h {
+				selected[k] = v
+			}
+			continue
+		}
+		if v := h.Values(name); len(v) > 0 {
+			selected[name] = v
+		}
+	}
+	for _, name := range ignoreHeaders {
+		delete(selected, name)
+	}
+	header, err := json.Marshal(selected)
+	if err != nil {
+		return "", err
+	}
+	return string(header), nil
+}
+
 func stringifyHeader(h http.Header) (string, error) {
 	header, err := json.Marshal(h)
 	if err != nil {
@@ -146,14 +365,94 @@ func generate(root SyntaxNode) *jen.Statement {
 	if len(root.children()) == 0 {
 		return nil
 	}
+	replayKey = 0
+	useReplay = false
+	useStream = false
+	useEncode = false
+	useBinary = false
+	useBodyHash = false
+	useTemplateRouter = false
+	fixtures = make(map[string][]byte)
+	generatedFlags = make(map[string]jen.Code)
+	// ヘルパー関数の要否はツリーを生成した結果で決まるので先に生成する
+	serverFuncs := generateServerFuncs(root, true, true)
+
 	var codes []jen.Code
 	codes = append(codes, generateStringify()...)
 	codes = append(codes, jen.Line())
 	codes = append(codes, generateStringifyUrlValues()...)
 	codes = append(codes, jen.Line())
+	if state.formRequests {
+		codes = append(codes, generateStringifyForm()...)
+		codes = append(codes, jen.Line())
+	}
+	if state.xmlRequests {
+		codes = append(codes, generateStringifyXML()...)
+		codes = append(codes, jen.Line())
+	}
+	if len(ignoreJSONPaths) > 0 {
+		codes = append(codes, generateIgnoreJSONFields()...)
+		codes = append(codes, jen.Line())
+	}
+	if len(matchHeaders) > 0 {
+		codes = append(codes, generateStringifySelectedHeader()...)
+		codes = append(codes, jen.Line())
+	}
+	if len(generatedFlags) > 0 {
+		codes = append(codes, generateFlagDefs()...)
+		codes = append(codes, jen.Line())
+	}
+	if useReplay {
+		codes = append(codes, generateNextResponse()...)
+		codes = append(codes, jen.Line())
+	}
+	if _, ok := generatedFlags["latency"]; ok {
+		codes = append(codes, generateDelay()...)
+		codes = append(codes, jen.Line())
+	}
+	if useStream {
+		codes = append(codes, generateStreamChunks()...)
+		codes = append(codes, jen.Line())
+	}
+	if useBinary {
+		codes = append(codes, generateBinaryBody()...)
+		codes = append(codes, jen.Line())
+	}
+	if useTemplateRouter {
+		codes = append(codes, generateTemplateRouter()...)
+		codes = append(codes, jen.Line())
+	}
+	if len(fixtures) > 0 {
+		codes = append(codes, generateFixture()...)
+		codes = append(codes, jen.Line())
+	}
+	if useBodyHash {
+		codes = append(codes, generateHashBody()...)
+		codes = append(codes, jen.Line())
+	}
+	if state.decodeRequests {
+		codes = append(codes, generateDecodeBody()...)
+		codes = append(codes, jen.Line())
+	}
+	if useEncode {
+		codes = append(codes, generateWriteEncoded()...)
+		codes = append(codes, jen.Line())
+	}
+	if _, ok := generatedFlags["fallback"]; ok {
+		codes = append(codes, generateFallback()...)
+		codes = append(codes, jen.Line())
+	}
+	if _, ok := generatedFlags["capture"]; ok {
+		codes = append(codes, generateProxyUpstream()...)
+		codes = append(codes, jen.Line())
+	}
+	if _, ok := generatedFlags["websocket"]; ok {
+		codes = append(codes, generateServeWebSocket()...)
+		codes = append(codes, jen.Line())
+	}
 	codes = append(codes, generateEnableLogRequest()...)
 	codes = append(codes, jen.Line())
-	codes = append(codes, generateServerFuncs(root, true, true)...)
+	codes = append(codes, serverFuncs...)
 	codes = append(codes, jen.Line())
 	codes = append(codes, generateMapComment(externalAPIToMockServerMap)...)
 	s := jen.Statement(codes)
@@ -197,6 +496,8 @@ func generateSignalHandler() []jen.Code {
 
 func generateStringify() []jen.Code {
 	return []jen.Code{
+		jen.Comment("stringify canonicalizes a JSON body (sorted keys, no spaces, numbers as is) and returns other bodies as is."),
+		jen.Line(),
 		jen.Func().Id("stringify").Params(jen.Id("r").Qual("io", "ReadCloser")).Parens(jen.List(jen.String(), jen.Error())).Block(
 			jen.If(jen.Id("r").Op("==").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Nil()),
@@ -206,11 +507,16 @@ func generateStringify() []jen.Code {
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
 			jen.Defer().Id("r").Dot("Close").Call(),
-			jen.Id("bm").Op(":=").Make(jen.Map(jen.String()).Interface()),
-			jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Id("body"), jen.Op("&").Id("bm")), jen.Err().Op("!=").Nil()).Block(
+			jen.Id("d").Op(":=").Qual("encoding/json", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("body"))),
+			jen.Id("d").Dot("UseNumber").Call(),
+			jen.Var().Id("v").Interface(),
+			jen.If(jen.Err().Op(":=").Id("d").Dot("Decode").Call(jen.Op("&").Id("v")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Id("string").Call(jen.Id("body")), jen.Err()),
 			),
-			jen.If(jen.List(jen.Id("j"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("bm")), jen.Err().Op("!=").Nil()).Block(
+			jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("d").Dot("Token").Call(), jen.Err().Op("!=").Qual("io", "EOF")).Block(
+				jen.Return(jen.Id("string").Call(jen.Id("body")), jen.Qual("fmt", "Errorf").Call(jen.Lit("invalid JSON: unexpected data after top-level value"))),
+			),
+			jen.If(jen.List(jen.Id("j"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("v")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Id("string").Call(jen.Id("body")), jen.Err()),
 			).Else().Block(
 				jen.Return(jen.Id("string").Call(jen.Id("j")), jen.Nil()),
@@ -220,14 +526,1071 @@ func generateStringify() []jen.Code {
 	}
 }
 
+func generateStringifyForm() []jen.Code {
+	return []jen.Code{
+		jen.Comment("stringifyForm normalizes a form body regardless of the field order and the multipart boundary."),
+		jen.Line(),
+		jen.Comment("File parts are compared by the hash of the content."),
+		jen.Line(),
+		jen.Func().Id("stringifyForm").Params(jen.Id("contentType"), jen.Id("body").String()).String().Block(
+			jen.List(jen.Id("mediaType"), jen.Id("params"), jen.Err()).Op(":=").Qual("mime", "ParseMediaType").Call(jen.Id("contentType")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Id("body")),
+			),
+			jen.Id("form").Op(":=").Make(jen.Map(jen.String()).Index().String()),
+			jen.Switch(jen.Id("mediaType")).Block(
+				jen.Case(jen.Lit("application/x-www-form-urlencoded")).Block(
+					jen.List(jen.Id("values"), jen.Err()).Op(":=").Qual("net/url", "ParseQuery").Call(jen.Id("body")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Id("body")),
+					),
+					jen.Id("form").Op("=").Id("values"),
+				),
+				jen.Case(jen.Lit("multipart/form-data")).Block(
+					jen.Id("mr").Op(":=").Qual("mime/multipart", "NewReader").Call(jen.Qual("strings", "NewReader").Call(jen.Id("body")), jen.Id("params").Index(jen.Lit("boundary"))),
+					jen.For().Block(
+						jen.List(jen.Id("part"), jen.Err()).Op(":=").Id("mr").Dot("NextPart").Call(),
+						jen.If(jen.Err().Op("==").Qual("io", "EOF")).Block(
+							jen.Break(),
+						),
+						jen.If(jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Id("body")),
+						),
+						jen.List(jen.Id("b"), jen.Err()).Op(":=").Qual("io", "ReadAll").Call(jen.Id("part")),
+						jen.If(jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Id("body")),
+						),
+						jen.Id("value").Op(":=").String().Call(jen.Id("b")),
+						jen.If(jen.Id("part").Dot("FileName").Call().Op("!=").Lit("")).Block(
+							jen.Id("sum").Op(":=").Qual("crypto/sha256", "Sum256").Call(jen.Id("b")),
+							jen.Id("value").Op("=").Lit("sha256:").Op("+").Qual("encoding/hex", "EncodeToString").Call(jen.Id("sum").Index(jen.Empty(), jen.Empty())),
+						),
+						jen.Id("form").Index(jen.Id("part").Dot("FormName").Call()).Op("=").Append(jen.Id("form").Index(jen.Id("part").Dot("FormName").Call()), jen.Id("value")),
+					),
+				),
+				jen.Default().Block(
+					jen.Return(jen.Id("body")),
+				),
+			),
+			jen.List(jen.Id("j"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("form")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Id("body")),
+			),
+			jen.Return(jen.String().Call(jen.Id("j"))),
+		),
+		jen.Line(),
+	}
+}
+
+func generateStringifyXML() []jen.Code {
+	ignored := jen.Dict{}
+	for _, name := range ignoreXMLElements {
+		ignored[jen.Lit(name)] = jen.True()
+	}
+	var operation []jen.Code
+	if soapMatch == "operation" {
+		operation = []jen.Code{
+			jen.If(jen.Id("op").Op(":=").Id("soapOperation").Call(jen.Id("header"), jen.Id("body")), jen.Id("op").Op("!=").Lit("")).Block(
+				jen.Return(jen.Lit("operation:").Op("+").Id("op")),
+			),
+		}
+	}
+	codes := []jen.Code{
+		jen.Comment("elements excluded when matching XML bodies"),
+		jen.Line(),
+		jen.Var().Id("ignoreXMLElements").Op("=").Map(jen.String()).Bool().Values(ignored),
+		jen.Line(),
+		jen.Comment("stringifyXML canonicalizes an XML body regardless of whitespace, attribute order and namespace prefixes."),
+		jen.Line(),
+		jen.Func().Id("stringifyXML").Params(jen.Id("header").Qual("net/http", "Header"), jen.Id("body").String()).String().BlockFunc(func(g *jen.Group) {
+			g.List(jen.Id("mediaType"), jen.Id("_"), jen.Err()).Op(":=").Qual("mime", "ParseMediaType").Call(jen.Id("header").Dot("Get").Call(jen.Lit("Content-Type")))
+			g.If(jen.Err().Op("!=").Nil().Op("||").Op("!").Parens(jen.Id("mediaType").Op("==").Lit("text/xml").Op("||").Id("mediaType").Op("==").Lit("application/xml").Op("||").Qual("strings", "HasSuffix").Call(jen.Id("mediaType"), jen.Lit("+xml")))).Block(
+				jen.Return(jen.Id("body")),
+			)
+			for _, c := range operation {
+				g.Add(c)
+			}
+			g.Id("d").Op(":=").Qual("encoding/xml", "NewDecoder").Call(jen.Qual("strings", "NewReader").Call(jen.Id("body")))
+			g.Var().Id("buf").Qual("strings", "Builder")
+			g.Id("skip").Op(":=").Lit(0)
+			g.Id("found").Op(":=").False()
+			g.For().Block(
+				jen.List(jen.Id("t"), jen.Err()).Op(":=").Id("d").Dot("Token").Call(),
+				jen.If(jen.Err().Op("==").Qual("io", "EOF")).Block(
+					jen.Break(),
+				),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Id("body")),
+				),
+				jen.Switch(jen.Id("t").Op(":=").Id("t").Assert(jen.Type())).Block(
+					jen.Case(jen.Qual("encoding/xml", "StartElement")).Block(
+						jen.If(jen.Id("skip").Op(">").Lit(0).Op("||").Id("ignoreXMLElements").Index(jen.Id("t").Dot("Name").Dot("Local"))).Block(
+							jen.Id("skip").Op("++"),
+							jen.Continue(),
+						),
+						jen.Var().Id("attrs").Index().String(),
+						jen.For(jen.List(jen.Id("_"), jen.Id("a")).Op(":=").Range().Id("t").Dot("Attr")).Block(
+							jen.If(jen.Id("a").Dot("Name").Dot("Space").Op("==").Lit("xmlns").Op("||").Parens(jen.Id("a").Dot("Name").Dot("Space").Op("==").Lit("").Op("&&").Id("a").Dot("Name").Dot("Local").Op("==").Lit("xmlns"))).Block(
+								jen.Continue(),
+							),
+							jen.Id("attrs").Op("=").Append(jen.Id("attrs"), jen.Qual("fmt", "Sprintf").Call(jen.Lit(" {%s}%s=%q"), jen.Id("a").Dot("Name").Dot("Space"), jen.Id("a").Dot("Name").Dot("Local"), jen.Id("a").Dot("Value"))),
+						),
+						jen.Qual("sort", "Strings").Call(jen.Id("attrs")),
+						jen.Id("found").Op("=").True(),
+						jen.Qual("fmt", "Fprintf").Call(jen.Op("&").Id("buf"), jen.Lit("<{%s}%s%s>"), jen.Id("t").Dot("Name").Dot("Space"), jen.Id("t").Dot("Name").Dot("Local"), jen.Qual("strings", "Join").Call(jen.Id("attrs"), jen.Lit(""))),
+					),
+					jen.Case(jen.Qual("encoding/xml", "EndElement")).Block(
+						jen.If(jen.Id("skip").Op(">").Lit(0)).Block(
+							jen.Id("skip").Op("--"),
+							jen.Continue(),
+						),
+						jen.Qual("fmt", "Fprintf").Call(jen.Op("&").Id("buf"), jen.Lit("</{%s}%s>"), jen.Id("t").Dot("Name").Dot("Space"), jen.Id("t").Dot("Name").Dot("Local")),
+					),
+					jen.Case(jen.Qual("encoding/xml", "CharData")).Block(
+						jen.If(jen.Id("skip").Op(">").Lit(0)).Block(
+							jen.Continue(),
+						),
+						jen.If(jen.Id("text").Op(":=").Qual("strings", "TrimSpace").Call(jen.String().Call(jen.Id("t"))), jen.Id("text").Op("!=").Lit("")).Block(
+							jen.Qual("encoding/xml", "EscapeText").Call(jen.Op("&").Id("buf"), jen.Index().Byte().Call(jen.Id("text"))),
+						),
+					),
+				),
+			)
+			g.If(jen.Op("!").Id("found")).Block(
+				jen.Return(jen.Id("body")),
+			)
+			g.Return(jen.Id("buf").Dot("String").Call())
+		}),
+		jen.Line(),
+	}
+	if soapMatch == "operation" {
+		codes = append(codes,
+			jen.Comment("soapOperation returns SOAPAction, the action of Content-Type or the first element in the SOAP Body."),
+			jen.Line(),
+			jen.Func().Id("soapOperation").Params(jen.Id("header").Qual("net/http", "Header"), jen.Id("body").String()).String().Block(
+				jen.If(jen.Id("action").Op(":=").Qual("strings", "Trim").Call(jen.Id("header").Dot("Get").Call(jen.Lit("SOAPAction")), jen.Lit(`"`)), jen.Id("action").Op("!=").Lit("")).Block(
+					jen.Return(jen.Id("action")),
+				),
+				jen.If(jen.List(jen.Id("_"), jen.Id("params"), jen.Err()).Op(":=").Qual("mime", "ParseMediaType").Call(jen.Id("header").Dot("Get").Call(jen.Lit("Content-Type"))), jen.Err().Op("==").Nil().Op("&&").Id("params").Index(jen.Lit("action")).Op("!=").Lit("")).Block(
+					jen.Return(jen.Id("params").Index(jen.Lit("action"))),
+				),
+				jen.Id("d").Op(":=").Qual("encoding/xml", "NewDecoder").Call(jen.Qual("strings", "NewReader").Call(jen.Id("body"))),
+				jen.Id("inBody").Op(":=").False(),
+				jen.For().Block(
+					jen.List(jen.Id("t"), jen.Err()).Op(":=").Id("d").Dot("Token").Call(),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Lit("")),
+					),
+					jen.If(jen.List(jen.Id("se"), jen.Id("ok")).Op(":=").Id("t").Assert(jen.Qual("encoding/xml", "StartElement")), jen.Id("ok")).Block(
+						jen.If(jen.Id("inBody")).Block(
+							jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit("{%s}%s"), jen.Id("se").Dot("Name").Dot("Space"), jen.Id("se").Dot("Name").Dot("Local"))),
+						),
+						jen.Id("inBody").Op("=").Id("se").Dot("Name").Dot("Local").Op("==").Lit("Body"),
+					),
+				),
+			),
+			jen.Line(),
+		)
+	}
+	return codes
+}
+
+func generateIgnoreJSONFields() []jen.Code {
+	paths := make([]jen.Code, 0, len(ignoreJSONPaths))
+	for _, path := range ignoreJSONPaths {
+		segments := make([]jen.Code, 0, len(path))
+		for _, segment := range path {
+			segments = append(segments, jen.Lit(segment))
+		}
+		paths = append(paths, jen.Values(segments...))
+	}
+	return []jen.Code{
+		jen.Comment("JSON fields excluded from matching (\"*\" matches any key or element)"),
+		jen.Line(),
+		jen.Var().Id("ignoreJSONPaths").Op("=").Index().Index().String().Values(paths...),
+		jen.Line(),
+		jen.Comment("ignoreJSONFields removes ignoreJSONPaths from a JSON body and returns other bodies as is."),
+		jen.Line(),
+		jen.Func().Id("ignoreJSONFields").Params(jen.Id("body").String()).String().Block(
+			jen.Id("d").Op(":=").Qual("encoding/json", "NewDecoder").Call(jen.Qual("strings", "NewReader").Call(jen.Id("body"))),
+			jen.Id("d").Dot("UseNumber").Call(),
+			jen.Var().Id("v").Interface(),
+			jen.If(jen.Err().Op(":=").Id("d").Dot("Decode").Call(jen.Op("&").Id("v")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Id("body")),
+			),
+			jen.For(jen.List(jen.Id("_"), jen.Id("path")).Op(":=").Range().Id("ignoreJSONPaths")).Block(
+				jen.Id("removeJSONPath").Call(jen.Id("v"), jen.Id("path")),
+			),
+			jen.List(jen.Id("j"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("v")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Id("body")),
+			),
+			jen.Return(jen.String().Call(jen.Id("j"))),
+		),
+		jen.Line(),
+		jen.Func().Id("removeJSONPath").Params(jen.Id("v").Interface(), jen.Id("path").Index().String()).Block(
+			jen.Switch(jen.Id("t").Op(":=").Id("v").Assert(jen.Type())).Block(
+				jen.Case(jen.Map(jen.String()).Interface()).Block(
+					jen.For(jen.List(jen.Id("k"), jen.Id("child")).Op(":=").Range().Id("t")).Block(
+						jen.If(jen.Id("path").Index(jen.Lit(0)).Op("!=").Lit("*").Op("&&").Id("path").Index(jen.Lit(0)).Op("!=").Id("k")).Block(
+							jen.Continue(),
+						),
+						jen.If(jen.Len(jen.Id("path")).Op("==").Lit(1)).Block(
+							jen.Delete(jen.Id("t"), jen.Id("k")),
+						).Else().Block(
+							jen.Id("removeJSONPath").Call(jen.Id("child"), jen.Id("path").Index(jen.Lit(1), jen.Empty())),
+						),
+					),
+				),
+				jen.Case(jen.Index().Interface()).Block(
+					jen.For(jen.List(jen.Id("i"), jen.Id("child")).Op(":=").Range().Id("t")).Block(
+						jen.If(jen.Id("path").Index(jen.Lit(0)).Op("!=").Lit("*").Op("&&").Id("path").Index(jen.Lit(0)).Op("!=").Qual("strconv", "Itoa").Call(jen.Id("i"))).Block(
+							jen.Continue(),
+						),
+						jen.If(jen.Len(jen.Id("path")).Op("==").Lit(1)).Block(
+							jen.Id("t").Index(jen.Id("i")).Op("=").Nil(),
+						).Else().Block(
+							jen.Id("removeJSONPath").Call(jen.Id("child"), jen.Id("path").Index(jen.Lit(1), jen.Empty())),
+						),
+					),
+				),
+			),
+		),
+		jen.Line(),
+	}
+}
+
 func generateStringifyUrlValues() []jen.Code {
+	var codes []jen.Code
+	if len(ignoreQueries) > 0 {
+		keys := make([]jen.Code, 0, len(ignoreQueries))
+		for _, key := range ignoreQueries {
+			keys = append(keys, jen.Lit(key))
+		}
+		codes = append(codes,
+			jen.Comment("query parameters excluded from matching"),
+			jen.Line(),
+			jen.Var().Id("ignoreQueries").Op("=").Index().String().Values(keys...),
+			jen.Line(),
+		)
+	}
+	return append(codes,
+		jen.Func().Id("stringifyUrlValues").Params(jen.Id("m").Qual("net/url", "Values")).Parens(jen.List(jen.String(), jen.Error())).BlockFunc(func(g *jen.Group) {
+			if len(ignoreQueries) > 0 {
+				g.For(jen.List(jen.Id("_"), jen.Id("key")).Op(":=").Range().Id("ignoreQueries")).Block(
+					jen.Id("m").Dot("Del").Call(jen.Id("key")),
+				)
+			}
+			g.List(jen.Id("query"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("m"))
+			g.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			)
+			g.Return(jen.Id("string").Call(jen.Id("query")), jen.Nil())
+		}),
+		jen.Line(),
+	)
+}
+
+func generateStringifySelectedHeader() []jen.Code {
+	names := make([]jen.Code, 0, len(matchHeaders))
+	for _, name := range matchHeaders {
+		names = append(names, jen.Lit(name))
+	}
+	ignored := make([]jen.Code, 0, len(ignoreHeaders))
+	for _, name := range ignoreHeaders {
+		ignored = append(ignored, jen.Lit(name))
+	}
 	return []jen.Code{
-		jen.Func().Id("stringifyUrlValues").Params(jen.Id("m").Qual("net/url", "Values")).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("query"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("m")),
+		jen.Var().Id("matchHeaders").Op("=").Index().String().Values(names...),
+		jen.Line(),
+		jen.Comment("headers excluded from matching even if matchHeaders contains \"*\""),
+		jen.Line(),
+		jen.Var().Id("ignoreHeaders").Op("=").Index().String().Values(ignored...),
+		jen.Line(),
+		jen.Func().Id("stringifySelectedHeader").Params(jen.Id("h").Qual("net/http", "Header"), jen.Id("names").Index().String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.Id("selected").Op(":=").Make(jen.Map(jen.String()).Index().String()),
+			jen.For(jen.List(jen.Id("_"), jen.Id("name")).Op(":=").Range().Id("names")).Block(
+				jen.If(jen.Id("name").Op("==").Lit("*")).Block(
+					jen.For(jen.List(jen.Id("k"), jen.Id("v")).Op(":=").Range().Id("h")).Block(
+						jen.Id("selected").Index(jen.Id("k")).Op("=").Id("v"),
+					),
+					jen.Continue(),
+				),
+				jen.If(jen.Id("v").Op(":=").Id("h").Dot("Values").Call(jen.Id("name")), jen.Len(jen.Id("v")).Op(">").Lit(0)).Block(
+					jen.Id("selected").Index(jen.Id("name")).Op("=").Id("v"),
+				),
+			),
+			jen.For(jen.List(jen.Id("_"), jen.Id("name")).Op(":=").Range().Id("ignoreHeaders")).Block(
+				jen.Id("delete").Call(jen.Id("selected"), jen.Id("name")),
+			),
+			jen.List(jen.Id("header"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("selected")),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Return(jen.Id("string").Call(jen.Id("query")), jen.Nil()),
+			jen.Return(jen.Id("string").Call(jen.Id("header")), jen.Nil()),
+		),
+		jen.Line(),
+	}
+}
+
+func generateFlagDefs() []jen.Code {
+	names := make([]string, 0, len(generatedFlags))
+	for name := range generatedFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defs := make([]jen.Code, 0, len(names))
+	for _, name := range names {
+		defs = append(defs, generatedFlags[name])
+	}
+	return []jen.Code{
+		jen.Var().Defs(defs...),
+		jen.Line(),
+	}
+}
+
+func generateNextResponse() []jen.Code {
+	return []jen.Code{
+		jen.Var().Defs(
+			jen.Id("replayMutex").Qual("sync", "Mutex"),
+			jen.Id("replayCounts").Op("=").Make(jen.Map(jen.String()).Int()),
+		),
+		jen.Line(),
+		jen.Comment("nextResponse returns the index of the response to replay for the n recorded responses."),
+		jen.Line(),
+		jen.Func().Id("nextResponse").Params(jen.Id("key").String(), jen.Id("n").Int()).Int().Block(
+			jen.Id("replayMutex").Dot("Lock").Call(),
+			jen.Defer().Id("replayMutex").Dot("Unlock").Call(),
+			jen.Id("i").Op(":=").Id("replayCounts").Index(jen.Id("key")),
+			jen.Id("replayCounts").Index(jen.Id("key")).Op("++"),
+			jen.Switch(jen.Op("*").Id("replayMode")).Block(
+				jen.Case(jen.Lit("cycle")).Block(
+					jen.Return(jen.Id("i").Op("%").Id("n")),
+				),
+				jen.Case(jen.Lit("random")).Block(
+					jen.Return(jen.Qual("math/rand", "Intn").Call(jen.Id("n"))),
+				),
+				jen.Default().Block(
+					jen.Comment("sequential: stick on the last response"),
+					jen.If(jen.Id("i").Op(">=").Id("n")).Block(
+						jen.Return(jen.Id("n").Op("-").Lit(1)),
+					),
+					jen.Return(jen.Id("i")),
+				),
+			),
+		),
+		jen.Line(),
+	}
+}
+
+func generateDelay() []jen.Code {
+	samples := jen.Dict{}
+	for route, latencies := range state.routeLatencies {
+		sorted := append([]time.Duration{}, latencies...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+		values := make([]jen.Code, 0, len(sorted))
+		for _, l := range sorted {
+			values = append(values, durationLit(l))
+		}
+		samples[jen.Lit(route)] = jen.Values(values...)
+	}
+	return []jen.Code{
+		jen.Comment("recorded latencies of each route in ascending order"),
+		jen.Line(),
+		jen.Var().Id("latencySamples").Op("=").Map(jen.String()).Index().Qual("time", "Duration").Values(samples),
+		jen.Line(),
+		jen.Comment("delay sleeps according to -latency: the recorded latency of the response or a percentile of the route."),
+		jen.Line(),
+		jen.Func().Id("delay").Params(jen.Id("route").String(), jen.Id("recorded").Qual("time", "Duration")).Block(
+			jen.Switch(jen.Op("*").Id("latencyMode")).Block(
+				jen.Case(jen.Lit("off")).Block(
+					jen.Return(),
+				),
+				jen.Case(jen.Lit("recorded")).Block(
+					jen.Qual("time", "Sleep").Call(jen.Id("recorded")),
+					jen.Return(),
+				),
+			),
+			jen.List(jen.Id("p"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Qual("strings", "TrimPrefix").Call(jen.Op("*").Id("latencyMode"), jen.Lit("p")), jen.Lit(64)),
+			jen.Id("samples").Op(":=").Id("latencySamples").Index(jen.Id("route")),
+			jen.If(jen.Err().Op("!=").Nil().Op("||").Len(jen.Id("samples")).Op("==").Lit(0)).Block(
+				jen.Return(),
+			),
+			jen.Comment("nearest-rank method"),
+			jen.Id("i").Op(":=").Int().Call(jen.Qual("math", "Ceil").Call(jen.Id("p").Op("/").Lit(100).Op("*").Float64().Call(jen.Len(jen.Id("samples"))))).Op("-").Lit(1),
+			jen.If(jen.Id("i").Op("<").Lit(0)).Block(
+				jen.Id("i").Op("=").Lit(0),
+			).Else().If(jen.Id("i").Op(">=").Len(jen.Id("samples"))).Block(
+				jen.Id("i").Op("=").Len(jen.Id("samples")).Op("-").Lit(1),
+			),
+			jen.Qual("time", "Sleep").Call(jen.Id("samples").Index(jen.Id("i"))),
+		),
+		jen.Line(),
+	}
+}
+
+func generateBinaryBody() []jen.Code {
+	return []jen.Code{
+		jen.Comment("binaryBody decodes a binary body embedded as base64."),
+		jen.Line(),
+		jen.Func().Id("binaryBody").Params(jen.Id("s").String()).Index().Byte().Block(
+			jen.List(jen.Id("b"), jen.Id("_")).Op(":=").Qual("encoding/base64", "StdEncoding").Dot("DecodeString").Call(jen.Id("s")),
+			jen.Return(jen.Id("b")),
+		),
+		jen.Line(),
+	}
+}
+
+func generateTemplateRouter() []jen.Code {
+	codes := []jen.Code{
+		jen.Comment("templateRouter routes requests to templated paths such as /users/{id} and the others to mux."),
+		jen.Line(),
+		jen.Type().Id("templateRouter").Struct(
+			jen.Id("mux").Op("*").Qual("net/http", "ServeMux"),
+			jen.Id("routes").Index().Id("templateRoute"),
+		),
+		jen.Line(),
+		jen.Type().Id("templateRoute").Struct(
+			jen.Id("segments").Index().String(),
+			jen.Id("params").Int(),
+			jen.Id("handler").Qual("net/http", "HandlerFunc"),
+		),
+		jen.Line(),
+		jen.Func().Params(jen.Id("t").Op("*").Id("templateRouter")).Id("HandleFunc").Params(jen.Id("template").String(), jen.Id("handler").Qual("net/http", "HandlerFunc")).Block(
+			jen.Id("route").Op(":=").Id("templateRoute").Values(jen.Dict{
+				jen.Id("segments"): jen.Qual("strings", "Split").Call(jen.Id("template"), jen.Lit("/")),
+				jen.Id("params"):   jen.Qual("strings", "Count").Call(jen.Id("template"), jen.Lit("{")),
+				jen.Id("handler"):  jen.Id("handler"),
+			}),
+			jen.Id("t").Dot("routes").Op("=").Append(jen.Id("t").Dot("routes"), jen.Id("route")),
+			jen.Comment("more specific templates first"),
+			jen.Qual("sort", "SliceStable").Call(jen.Id("t").Dot("routes"), jen.Func().Params(jen.List(jen.Id("i"), jen.Id("j")).Int()).Bool().Block(
+				jen.Return(jen.Id("t").Dot("routes").Index(jen.Id("i")).Dot("params").Op("<").Id("t").Dot("routes").Index(jen.Id("j")).Dot("params")),
+			)),
+		),
+		jen.Line(),
+		jen.Func().Params(jen.Id("t").Op("*").Id("templateRouter")).Id("ServeHTTP").Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Op("*").Qual("net/http", "Request")).Block(
+			jen.Comment("paths recorded without parameters take precedence over templates"),
+			jen.If(jen.List(jen.Id("_"), jen.Id("pattern")).Op(":=").Id("t").Dot("mux").Dot("Handler").Call(jen.Id("r")), jen.Id("pattern").Op("==").Id("r").Dot("URL").Dot("Path")).Block(
+				jen.Id("t").Dot("mux").Dot("ServeHTTP").Call(jen.Id("rw"), jen.Id("r")),
+				jen.Return(),
+			),
+			jen.Id("segments").Op(":=").Qual("strings", "Split").Call(jen.Id("r").Dot("URL").Dot("Path"), jen.Lit("/")),
+			jen.For(jen.List(jen.Id("_"), jen.Id("route")).Op(":=").Range().Id("t").Dot("routes")).Block(
+				jen.If(jen.Id("matchSegments").Call(jen.Id("route").Dot("segments"), jen.Id("segments"))).Block(
+					jen.Id("route").Dot("handler").Call(jen.Id("rw"), jen.Id("r")),
+					jen.Return(),
+				),
+			),
+			jen.Id("t").Dot("mux").Dot("ServeHTTP").Call(jen.Id("rw"), jen.Id("r")),
+		),
+		jen.Line(),
+		jen.Func().Id("matchSegments").Params(jen.List(jen.Id("template"), jen.Id("segments")).Index().String()).Bool().Block(
+			jen.If(jen.Len(jen.Id("template")).Op("!=").Len(jen.Id("segments"))).Block(
+				jen.Return(jen.False()),
+			),
+			jen.For(jen.List(jen.Id("i"), jen.Id("s")).Op(":=").Range().Id("template")).Block(
+				jen.If(jen.Qual("strings", "HasPrefix").Call(jen.Id("s"), jen.Lit("{")).Op("&&").Qual("strings", "HasSuffix").Call(jen.Id("s"), jen.Lit("}"))).Block(
+					jen.If(jen.Id("segments").Index(jen.Id("i")).Op("==").Lit("")).Block(
+						jen.Return(jen.False()),
+					),
+					jen.Continue(),
+				),
+				jen.If(jen.Id("s").Op("!=").Id("segments").Index(jen.Id("i"))).Block(
+					jen.Return(jen.False()),
+				),
+			),
+			jen.Return(jen.True()),
+		),
+		jen.Line(),
+	}
+	if !anyPathValue {
+		return codes
+	}
+	return append(codes,
+		jen.Comment("recordedPath returns path if it was recorded, otherwise the first of the recorded paths in lexical order."),
+		jen.Line(),
+		jen.Func().Id("recordedPath").Params(jen.Id("path").String(), jen.Id("recorded").Op("...").String()).String().Block(
+			jen.For(jen.List(jen.Id("_"), jen.Id("p")).Op(":=").Range().Id("recorded")).Block(
+				jen.If(jen.Id("p").Op("==").Id("path")).Block(
+					jen.Return(jen.Id("path")),
+				),
+			),
+			jen.Return(jen.Id("recorded").Index(jen.Lit(0))),
+		),
+		jen.Line(),
+	)
+}
+
+func generateFallback() []jen.Code {
+	request := jen.Dict{
+		jen.Id("Method"): jen.Id("r").Dot("Method"),
+		jen.Id("Path"):   jen.Id("r").Dot("URL").Dot("Path"),
+		jen.Id("Query"):  jen.Id("q"),
+		jen.Id("Body"):   jen.Id("body"),
+	}
+	var header []jen.Code
+	if len(matchHeaders) > 0 {
+		request[jen.Id("Header")] = jen.Id("h")
+		header = append(header, jen.List(jen.Id("h"), jen.Id("_")).Op(":=").Id("stringifySelectedHeader").Call(jen.Id("r").Dot("Header"), jen.Id("matchHeaders")))
+	}
+	candidate := func(i string) *jen.Statement {
+		return jen.Id("candidates").Index(jen.Id(i))
+	}
+	return []jen.Code{
+		jen.Comment("fallbackCandidate is a recorded request in the form compared by the handlers."),
+		jen.Line(),
+		jen.Type().Id("fallbackCandidate").Struct(
+			jen.Id("Method").String().Tag(map[string]string{"json": "method"}),
+			jen.Id("Path").String().Tag(map[string]string{"json": "path"}),
+			jen.Id("Query").String().Tag(map[string]string{"json": "query"}),
+			jen.Id("Header").String().Tag(map[string]string{"json": "header,omitempty"}),
+			jen.Id("Body").String().Tag(map[string]string{"json": "body"}),
+			jen.Id("Score").Float64().Tag(map[string]string{"json": "score,omitempty"}),
+		),
+		jen.Line(),
+		jen.Line(),
+		jen.Type().Id("fallbackKey").Struct(),
+		jen.Line(),
+		jen.Comment("fallback responds to a request matching no recorded request according to -fallback."),
+		jen.Line(),
+		jen.Func().Id("fallback").Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Op("*").Qual("net/http", "Request"), jen.Id("handler").Qual("net/http", "Handler"), jen.Id("upstream").String(), jen.Id("body").String(), jen.Id("candidates").Index().Id("fallbackCandidate")).BlockFunc(func(g *jen.Group) {
+			g.List(jen.Id("q"), jen.Id("_")).Op(":=").Id("stringifyUrlValues").Call(jen.Id("r").Dot("URL").Dot("Query").Call())
+			for _, code := range header {
+				g.Add(code)
+			}
+			g.Id("request").Op(":=").Id("fallbackCandidate").Values(request)
+			g.For(jen.Id("i").Op(":=").Range().Id("candidates")).Block(
+				candidate("i").Dot("Score").Op("=").Id("request").Dot("similarity").Call(candidate("i")),
+			)
+			g.Qual("sort", "SliceStable").Call(jen.Id("candidates"), jen.Func().Params(jen.List(jen.Id("i"), jen.Id("j")).Int()).Bool().Block(
+				jen.Return(candidate("i").Dot("Score").Op(">").Add(candidate("j")).Dot("Score")),
+			))
+			g.Id("status").Op(":=").Qual("net/http", "StatusNotFound")
+			g.Switch(jen.Op("*").Id("fallbackMode")).BlockFunc(func(g *jen.Group) {
+				if _, ok := generatedFlags["capture"]; ok {
+					g.Case(jen.Lit("proxy")).Block(
+						jen.Id("proxyUpstream").Call(jen.Id("rw"), jen.Id("r"), jen.Id("upstream")),
+						jen.Return(),
+					)
+				}
+				g.Case(jen.Lit("nearest")).Block(
+					jen.Comment("replay the closest one unless it is the replayed request itself"),
+					jen.If(jen.List(jen.Id("_"), jen.Id("replayed")).Op(":=").Id("r").Dot("Context").Call().Dot("Value").Call(jen.Id("fallbackKey").Values()).Assert(jen.Id("fallbackCandidate")), jen.Op("!").Id("replayed").Op("&&").Len(jen.Id("candidates")).Op(">").Lit(0)).Block(
+						jen.Id("handler").Dot("ServeHTTP").Call(jen.Id("rw"), candidate("0").Dot("request").Call(jen.Id("r"))),
+						jen.Return(),
+					),
+				)
+				g.Case(jen.Lit("501")).Block(
+					jen.Id("status").Op("=").Qual("net/http", "StatusNotImplemented"),
+				)
+				g.Case(jen.Lit("404")).Block()
+				g.Default().Block(
+					jen.Return(),
+				)
+			})
+			g.If(jen.Len(jen.Id("candidates")).Op(">").Lit(3)).Block(
+				jen.Id("candidates").Op("=").Id("candidates").Index(jen.Empty(), jen.Lit(3)),
+			)
+			g.Id("rw").Dot("Header").Call().Dot("Set").Call(jen.Lit("Content-Type"), jen.Lit("application/json"))
+			g.Id("rw").Dot("WriteHeader").Call(jen.Id("status"))
+			g.Qual("encoding/json", "NewEncoder").Call(jen.Id("rw")).Dot("Encode").Call(jen.Map(jen.String()).Interface().Values(jen.Dict{
+				jen.Lit("error"):      jen.Lit("no recorded request matched"),
+				jen.Lit("request"):    jen.Id("request"),
+				jen.Lit("candidates"): jen.Id("candidates"),
+			}))
+		}),
+		jen.Line(),
+		jen.Comment("similarity weighs the method and the path more than the query, the headers and the body."),
+		jen.Line(),
+		jen.Func().Params(jen.Id("c").Id("fallbackCandidate")).Id("similarity").Params(jen.Id("o").Id("fallbackCandidate")).Float64().Block(
+			jen.Return(
+				jen.Lit(4).Op("*").Id("stringSimilarity").Call(jen.Id("c").Dot("Method"), jen.Id("o").Dot("Method")).Op("+").
+					Lit(3).Op("*").Id("stringSimilarity").Call(jen.Id("c").Dot("Path"), jen.Id("o").Dot("Path")).Op("+").
+					Id("stringSimilarity").Call(jen.Id("c").Dot("Query"), jen.Id("o").Dot("Query")).Op("+").
+					Id("stringSimilarity").Call(jen.Id("c").Dot("Header"), jen.Id("o").Dot("Header")).Op("+").
+					Id("stringSimilarity").Call(jen.Id("c").Dot("Body"), jen.Id("o").Dot("Body")),
+			),
+		),
+		jen.Line(),
+		jen.Comment("stringSimilarity returns the ratio of the common prefix and suffix to the longer string."),
+		jen.Line(),
+		jen.Func().Id("stringSimilarity").Params(jen.List(jen.Id("a"), jen.Id("b")).String()).Float64().Block(
+			jen.If(jen.Id("a").Op("==").Id("b")).Block(
+				jen.Return(jen.Lit(1)),
+			),
+			jen.Id("n").Op(":=").Len(jen.Id("a")),
+			jen.If(jen.Len(jen.Id("b")).Op(">").Id("n")).Block(
+				jen.Id("n").Op("=").Len(jen.Id("b")),
+			),
+			jen.Id("prefix").Op(":=").Lit(0),
+			jen.For(jen.Id("prefix").Op("<").Len(jen.Id("a")).Op("&&").Id("prefix").Op("<").Len(jen.Id("b")).Op("&&").Id("a").Index(jen.Id("prefix")).Op("==").Id("b").Index(jen.Id("prefix"))).Block(
+				jen.Id("prefix").Op("++"),
+			),
+			jen.Id("suffix").Op(":=").Lit(0),
+			jen.For(jen.Id("suffix").Op("<").Len(jen.Id("a")).Op("-").Id("prefix").Op("&&").Id("suffix").Op("<").Len(jen.Id("b")).Op("-").Id("prefix").Op("&&").Id("a").Index(jen.Len(jen.Id("a")).Op("-").Lit(1).Op("-").Id("suffix")).Op("==").Id("b").Index(jen.Len(jen.Id("b")).Op("-").Lit(1).Op("-").Id("suffix"))).Block(
+				jen.Id("suffix").Op("++"),
+			),
+			jen.Return(jen.Float64().Call(jen.Id("prefix").Op("+").Id("suffix")).Op("/").Float64().Call(jen.Id("n"))),
+		),
+		jen.Line(),
+		jen.Comment("request returns r rewritten into the candidate so that the handler replays its response."),
+		jen.Line(),
+		jen.Func().Params(jen.Id("c").Id("fallbackCandidate")).Id("request").Params(jen.Id("r").Op("*").Qual("net/http", "Request")).Op("*").Qual("net/http", "Request").Block(
+			jen.Id("replay").Op(":=").Id("r").Dot("Clone").Call(jen.Qual("context", "WithValue").Call(jen.Id("r").Dot("Context").Call(), jen.Id("fallbackKey").Values(), jen.Id("c"))),
+			jen.Id("replay").Dot("Method").Op("=").Id("c").Dot("Method"),
+			jen.Id("replay").Dot("URL").Dot("Path").Op("=").Id("c").Dot("Path"),
+			jen.Id("replay").Dot("URL").Dot("RawPath").Op("=").Lit(""),
+			jen.Var().Id("query").Qual("net/url", "Values"),
+			jen.Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Call(jen.Id("c").Dot("Query")), jen.Op("&").Id("query")),
+			jen.Id("replay").Dot("URL").Dot("RawQuery").Op("=").Id("query").Dot("Encode").Call(),
+			jen.If(jen.Id("c").Dot("Header").Op("!=").Lit("")).Block(
+				jen.Var().Id("header").Map(jen.String()).Index().String(),
+				jen.Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Call(jen.Id("c").Dot("Header")), jen.Op("&").Id("header")),
+				jen.Id("replay").Dot("Header").Op("=").Make(jen.Qual("net/http", "Header")),
+				jen.For(jen.List(jen.Id("k"), jen.Id("vv")).Op(":=").Range().Id("header")).Block(
+					jen.For(jen.List(jen.Id("_"), jen.Id("v")).Op(":=").Range().Id("vv")).Block(
+						jen.Id("replay").Dot("Header").Dot("Add").Call(jen.Id("k"), jen.Id("v")),
+					),
+				),
+			),
+			jen.Id("replay").Dot("Body").Op("=").Qual("net/http", "NoBody"),
+			jen.Return(jen.Id("replay")),
+		),
+		jen.Line(),
+		jen.Comment("keepBody lets the request body be read again with r.GetBody."),
+		jen.Line(),
+		jen.Func().Id("keepBody").Params(jen.Id("r").Op("*").Qual("net/http", "Request")).Block(
+			jen.List(jen.Id("b"), jen.Id("_")).Op(":=").Qual("io", "ReadAll").Call(jen.Id("r").Dot("Body")),
+			jen.Id("r").Dot("Body").Dot("Close").Call(),
+			jen.Id("r").Dot("Body").Op("=").Qual("io", "NopCloser").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("b"))),
+			jen.Id("r").Dot("GetBody").Op("=").Func().Params().Params(jen.Qual("io", "ReadCloser"), jen.Error()).Block(
+				jen.Return(jen.Qual("io", "NopCloser").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("b"))), jen.Nil()),
+			),
+		),
+		jen.Line(),
+	}
+}
+
+func generateProxyUpstream() []jen.Code {
+	badGateway := func() jen.Code {
+		return jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("net/http", "Error").Call(jen.Id("rw"), jen.Err().Dot("Error").Call(), jen.Qual("net/http", "StatusBadGateway")),
+			jen.Return(),
+		)
+	}
+	return []jen.Code{
+		jen.Comment("capturedFlow is a line of a capture file read by gstbgen generate --from."),
+		jen.Line(),
+		jen.Type().Id("capturedFlow").Struct(
+			jen.Id("Version").Int().Tag(map[string]string{"json": "version"}),
+			jen.Id("ID").String().Tag(map[string]string{"json": "id"}),
+			jen.Id("StartedAt").Qual("time", "Time").Tag(map[string]string{"json": "startedAt"}),
+			jen.Id("Request").Struct(
+				jen.Id("Method").String().Tag(map[string]string{"json": "method"}),
+				jen.Id("URL").String().Tag(map[string]string{"json": "url"}),
+				jen.Id("Host").String().Tag(map[string]string{"json": "host"}),
+				jen.Id("Proto").String().Tag(map[string]string{"json": "proto,omitempty"}),
+				jen.Id("Header").Qual("net/http", "Header").Tag(map[string]string{"json": "header,omitempty"}),
+				jen.Id("Body").Index().Byte().Tag(map[string]string{"json": "body,omitempty"}),
+			).Tag(map[string]string{"json": "request"}),
+			jen.Id("Response").Struct(
+				jen.Id("StatusCode").Int().Tag(map[string]string{"json": "statusCode"}),
+				jen.Id("Proto").String().Tag(map[string]string{"json": "proto,omitempty"}),
+				jen.Id("Header").Qual("net/http", "Header").Tag(map[string]string{"json": "header,omitempty"}),
+				jen.Id("Body").Index().Byte().Tag(map[string]string{"json": "body,omitempty"}),
+			).Tag(map[string]string{"json": "response"}),
+			jen.Id("Wait").Qual("time", "Duration").Tag(map[string]string{"json": "wait,omitempty"}),
+		),
+		jen.Line(),
+		jen.Var().Id("captureMutex").Qual("sync", "Mutex"),
+		jen.Line(),
+		jen.Comment("proxyUpstream forwards r to the upstream, returns its response and appends the flow to -capture."),
+		jen.Line(),
+		jen.Func().Id("proxyUpstream").Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Op("*").Qual("net/http", "Request"), jen.Id("upstream").String()).Block(
+			jen.Var().Id("reqBody").Index().Byte(),
+			jen.If(jen.Id("r").Dot("GetBody").Op("!=").Nil()).Block(
+				jen.If(jen.List(jen.Id("b"), jen.Err()).Op(":=").Id("r").Dot("GetBody").Call(), jen.Err().Op("==").Nil()).Block(
+					jen.List(jen.Id("reqBody"), jen.Id("_")).Op("=").Qual("io", "ReadAll").Call(jen.Id("b")),
+				),
+			),
+			jen.Id("startedAt").Op(":=").Qual("time", "Now").Call(),
+			jen.List(jen.Id("req"), jen.Err()).Op(":=").Qual("net/http", "NewRequestWithContext").Call(jen.Id("r").Dot("Context").Call(), jen.Id("r").Dot("Method"), jen.Id("upstream").Op("+").Id("r").Dot("URL").Dot("RequestURI").Call(), jen.Qual("bytes", "NewReader").Call(jen.Id("reqBody"))),
+			badGateway(),
+			jen.Id("req").Dot("Header").Op("=").Id("r").Dot("Header").Dot("Clone").Call(),
+			jen.Id("removeHopHeaders").Call(jen.Id("req").Dot("Header")),
+			jen.Comment("let the transport decompress the response so that it is recorded as is"),
+			jen.Id("req").Dot("Header").Dot("Del").Call(jen.Lit("Accept-Encoding")),
+			jen.List(jen.Id("res"), jen.Err()).Op(":=").Qual("net/http", "DefaultTransport").Dot("RoundTrip").Call(jen.Id("req")),
+			badGateway(),
+			jen.Defer().Id("res").Dot("Body").Dot("Close").Call(),
+			jen.Id("wait").Op(":=").Qual("time", "Since").Call(jen.Id("startedAt")),
+			jen.List(jen.Id("resBody"), jen.Err()).Op(":=").Qual("io", "ReadAll").Call(jen.Id("res").Dot("Body")),
+			badGateway(),
+			jen.Id("removeHopHeaders").Call(jen.Id("res").Dot("Header")),
+			jen.For(jen.List(jen.Id("k"), jen.Id("vv")).Op(":=").Range().Id("res").Dot("Header")).Block(
+				jen.For(jen.List(jen.Id("_"), jen.Id("v")).Op(":=").Range().Id("vv")).Block(
+					jen.Id("rw").Dot("Header").Call().Dot("Add").Call(jen.Id("k"), jen.Id("v")),
+				),
+			),
+			jen.Id("rw").Dot("WriteHeader").Call(jen.Id("res").Dot("StatusCode")),
+			jen.Id("rw").Dot("Write").Call(jen.Id("resBody")),
+			jen.If(jen.Op("*").Id("captureFile").Op("==").Lit("")).Block(
+				jen.Return(),
+			),
+			jen.Var().Id("flow").Id("capturedFlow"),
+			jen.Id("flow").Dot("Version").Op("=").Lit(captureVersion),
+			jen.Id("flow").Dot("ID").Op("=").Id("newFlowID").Call(),
+			jen.Id("flow").Dot("StartedAt").Op("=").Id("startedAt"),
+			jen.Id("flow").Dot("Request").Dot("Method").Op("=").Id("req").Dot("Method"),
+			jen.Id("flow").Dot("Request").Dot("URL").Op("=").Id("req").Dot("URL").Dot("String").Call(),
+			jen.Id("flow").Dot("Request").Dot("Host").Op("=").Id("req").Dot("URL").Dot("Host"),
+			jen.Id("flow").Dot("Request").Dot("Proto").Op("=").Id("r").Dot("Proto"),
+			jen.Id("flow").Dot("Request").Dot("Header").Op("=").Id("r").Dot("Header"),
+			jen.Id("flow").Dot("Request").Dot("Body").Op("=").Id("reqBody"),
+			jen.Id("flow").Dot("Response").Dot("StatusCode").Op("=").Id("res").Dot("StatusCode"),
+			jen.Id("flow").Dot("Response").Dot("Proto").Op("=").Id("res").Dot("Proto"),
+			jen.Id("flow").Dot("Response").Dot("Header").Op("=").Id("res").Dot("Header"),
+			jen.Id("flow").Dot("Response").Dot("Body").Op("=").Id("resBody"),
+			jen.Id("flow").Dot("Wait").Op("=").Id("wait"),
+			jen.If(jen.Err().Op(":=").Id("appendCapture").Call(jen.Id("flow")), jen.Err().Op("!=").Nil()).Block(
+				jen.Qual("log", "Printf").Call(jen.Lit("failed to record %s %s: %v\n"), jen.Id("req").Dot("Method"), jen.Id("req").Dot("URL"), jen.Err()),
+			),
+		),
+		jen.Line(),
+		jen.Comment("hopHeaders are the hop-by-hop headers removed by httputil.ReverseProxy."),
+		jen.Line(),
+		jen.Var().Id("hopHeaders").Op("=").Index().String().Values(
+			jen.Lit("Connection"),
+			jen.Lit("Proxy-Connection"),
+			jen.Lit("Keep-Alive"),
+			jen.Lit("Proxy-Authenticate"),
+			jen.Lit("Proxy-Authorization"),
+			jen.Lit("Te"),
+			jen.Lit("Trailer"),
+			jen.Lit("Transfer-Encoding"),
+			jen.Lit("Upgrade"),
+		),
+		jen.Line(),
+		jen.Comment("removeHopHeaders removes the hop-by-hop headers including the ones listed in Connection."),
+		jen.Line(),
+		jen.Func().Id("removeHopHeaders").Params(jen.Id("h").Qual("net/http", "Header")).Block(
+			jen.For(jen.List(jen.Id("_"), jen.Id("f")).Op(":=").Range().Id("h").Dot("Values").Call(jen.Lit("Connection"))).Block(
+				jen.For(jen.List(jen.Id("_"), jen.Id("name")).Op(":=").Range().Qual("strings", "Split").Call(jen.Id("f"), jen.Lit(","))).Block(
+					jen.If(jen.Id("name").Op("=").Qual("strings", "TrimSpace").Call(jen.Id("name")), jen.Id("name").Op("!=").Lit("")).Block(
+						jen.Id("h").Dot("Del").Call(jen.Id("name")),
+					),
+				),
+			),
+			jen.For(jen.List(jen.Id("_"), jen.Id("name")).Op(":=").Range().Id("hopHeaders")).Block(
+				jen.Id("h").Dot("Del").Call(jen.Id("name")),
+			),
+		),
+		jen.Line(),
+		jen.Comment("appendCapture writes the flow as a line so that the flows written before remain if the stub stops."),
+		jen.Line(),
+		jen.Func().Id("appendCapture").Params(jen.Id("flow").Id("capturedFlow")).Error().Block(
+			jen.List(jen.Id("line"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("flow")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Err()),
+			),
+			jen.Id("captureMutex").Dot("Lock").Call(),
+			jen.Defer().Id("captureMutex").Dot("Unlock").Call(),
+			jen.List(jen.Id("f"), jen.Err()).Op(":=").Qual("os", "OpenFile").Call(jen.Op("*").Id("captureFile"), jen.Qual("os", "O_CREATE").Op("|").Qual("os", "O_WRONLY").Op("|").Qual("os", "O_APPEND"), jen.Op("0644")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Err()),
+			),
+			jen.Defer().Id("f").Dot("Close").Call(),
+			jen.List(jen.Id("_"), jen.Err()).Op("=").Id("f").Dot("Write").Call(jen.Append(jen.Id("line"), jen.LitRune('\n'))),
+			jen.Return(jen.Err()),
+		),
+		jen.Line(),
+		jen.Line(),
+		jen.Comment("newFlowID returns a random ID not to collide with the flows recorded before."),
+		jen.Line(),
+		jen.Func().Id("newFlowID").Params().String().Block(
+			jen.Id("b").Op(":=").Make(jen.Index().Byte(), jen.Lit(16)),
+			jen.Qual("crypto/rand", "Read").Call(jen.Id("b")),
+			jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit("%x"), jen.Id("b"))),
+		),
+		jen.Line(),
+	}
+}
+
+func generateFixture() []jen.Code {
+	return []jen.Code{
+		jen.Comment("//go:embed " + fixtureDir),
+		jen.Line(),
+		jen.Var().Id("fixtureFS").Qual("embed", "FS"),
+		jen.Line(),
+		jen.Comment("fixture reads a body written into the " + fixtureDir + " directory."),
+		jen.Line(),
+		jen.Func().Id("fixture").Params(jen.Id("name").String()).Index().Byte().Block(
+			jen.List(jen.Id("b"), jen.Err()).Op(":=").Id("fixtureFS").Dot("ReadFile").Call(jen.Lit(fixtureDir+"/").Op("+").Id("name")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Panic(jen.Err()),
+			),
+			jen.Return(jen.Id("b")),
+		),
+		jen.Line(),
+	}
+}
+
+func generateHashBody() []jen.Code {
+	return []jen.Code{
+		jen.Comment("hashBody returns the SHA-256 of the request body to match large bodies."),
+		jen.Line(),
+		jen.Func().Id("hashBody").Params(jen.Id("body").String()).String().Block(
+			jen.Id("sum").Op(":=").Qual("crypto/sha256", "Sum256").Call(jen.Index().Byte().Call(jen.Id("body"))),
+			jen.Return(jen.Qual("encoding/hex", "EncodeToString").Call(jen.Id("sum").Index(jen.Empty(), jen.Empty()))),
+		),
+		jen.Line(),
+	}
+}
+
+// fixturesを生成コードと同じディレクトリのfixtureDirに書き出す
+func writeFixtures(out string) error {
+	if len(fixtures) == 0 {
+		return nil
+	}
+	dir := filepath.Join(filepath.Dir(out), fixtureDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create fixture directory: %w", err)
+	}
+	for name, body := range fixtures {
+		if err := os.WriteFile(filepath.Join(dir, name), body, 0644); err != nil {
+			return fmt.Errorf("failed to write fixture: %w", err)
+		}
+	}
+	return nil
+}
+
+const brotliPackage = "github.com/andybalholm/brotli"
+
+// brを記録していたときだけbrotliのパッケージを使うcaseを生成する
+func brotliCase(code jen.Code) jen.Code {
+	if !state.brotli {
+		return jen.Null()
+	}
+	return jen.Case(jen.Lit("br")).Block(code)
+}
+
+func generateDecodeBody() []jen.Code {
+	reader := func() jen.Code {
+		return jen.Qual("bytes", "NewReader").Call(jen.Id("body"))
+	}
+	raw := func() jen.Code {
+		return jen.Return(jen.Qual("io", "NopCloser").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("raw"))))
+	}
+	return []jen.Code{
+		jen.Comment("decodeBody decompresses the request body according to Content-Encoding in the reverse order of the codings applied."),
+		jen.Line(),
+		jen.Func().Id("decodeBody").Params(jen.Id("r").Op("*").Qual("net/http", "Request")).Qual("io", "ReadCloser").Block(
+			jen.List(jen.Id("body"), jen.Id("_")).Op(":=").Qual("io", "ReadAll").Call(jen.Id("r").Dot("Body")),
+			jen.Id("r").Dot("Body").Dot("Close").Call(),
+			jen.Id("raw").Op(":=").Id("body"),
+			jen.Id("codings").Op(":=").Qual("strings", "Split").Call(jen.Id("r").Dot("Header").Dot("Get").Call(jen.Lit("Content-Encoding")), jen.Lit(",")),
+			jen.For(jen.Id("i").Op(":=").Len(jen.Id("codings")).Op("-").Lit(1), jen.Id("i").Op(">=").Lit(0), jen.Id("i").Op("--")).Block(
+				jen.Var().Id("decoded").Qual("io", "Reader"),
+				jen.Var().Err().Error(),
+				jen.Switch(jen.Qual("strings", "ToLower").Call(jen.Qual("strings", "TrimSpace").Call(jen.Id("codings").Index(jen.Id("i"))))).Block(
+					jen.Case(jen.Lit(""), jen.Lit("identity")).Block(
+						jen.Continue(),
+					),
+					jen.Case(jen.Lit("gzip"), jen.Lit("x-gzip")).Block(
+						jen.List(jen.Id("decoded"), jen.Err()).Op("=").Qual("compress/gzip", "NewReader").Call(reader()),
+					),
+					jen.Case(jen.Lit("deflate")).Block(
+						jen.Comment("some servers send raw deflate instead of zlib"),
+						jen.If(jen.List(jen.Id("decoded"), jen.Err()).Op("=").Qual("compress/zlib", "NewReader").Call(reader()), jen.Err().Op("!=").Nil()).Block(
+							jen.List(jen.Id("decoded"), jen.Err()).Op("=").List(jen.Qual("compress/flate", "NewReader").Call(reader()), jen.Nil()),
+						),
+					),
+					brotliCase(jen.Id("decoded").Op("=").Qual(brotliPackage, "NewReader").Call(reader())),
+					jen.Default().Block(
+						raw(),
+					),
+				),
+				jen.If(jen.Err().Op("==").Nil()).Block(
+					jen.List(jen.Id("body"), jen.Err()).Op("=").Qual("io", "ReadAll").Call(jen.Id("decoded")),
+				),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					raw(),
+				),
+			),
+			jen.Return(jen.Qual("io", "NopCloser").Call(reader())),
+		),
+		jen.Line(),
+	}
+}
+
+func generateWriteEncoded() []jen.Code {
+	return []jen.Code{
+		jen.Comment("writeEncoded compresses the body with an encoding accepted by the client, preferring the recorded one."),
+		jen.Line(),
+		jen.Func().Id("writeEncoded").Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Op("*").Qual("net/http", "Request"), jen.Id("statusCode").Int(), jen.Id("recorded"), jen.Id("body").String()).Block(
+			jen.Id("rw").Dot("Header").Call().Dot("Add").Call(jen.Lit("Vary"), jen.Lit("Accept-Encoding")),
+			jen.Id("encoding").Op(":=").Id("acceptedEncoding").Call(jen.Id("r").Dot("Header").Dot("Get").Call(jen.Lit("Accept-Encoding")), jen.Id("recorded")),
+			jen.Var().Id("w").Qual("io", "WriteCloser"),
+			jen.Switch(jen.Id("encoding")).Block(
+				jen.Case(jen.Lit("gzip")).Block(
+					jen.Id("w").Op("=").Qual("compress/gzip", "NewWriter").Call(jen.Id("rw")),
+				),
+				jen.Case(jen.Lit("deflate")).Block(
+					jen.Id("w").Op("=").Qual("compress/zlib", "NewWriter").Call(jen.Id("rw")),
+				),
+				brotliCase(jen.Id("w").Op("=").Qual(brotliPackage, "NewWriter").Call(jen.Id("rw"))),
+				jen.Default().Block(
+					jen.Id("rw").Dot("WriteHeader").Call(jen.Id("statusCode")),
+					jen.Qual("fmt", "Fprint").Call(jen.Id("rw"), jen.Id("body")),
+					jen.Return(),
+				),
+			),
+			jen.Id("rw").Dot("Header").Call().Dot("Set").Call(jen.Lit("Content-Encoding"), jen.Id("encoding")),
+			jen.Id("rw").Dot("WriteHeader").Call(jen.Id("statusCode")),
+			jen.Qual("fmt", "Fprint").Call(jen.Id("w"), jen.Id("body")),
+			jen.Id("w").Dot("Close").Call(),
+		),
+		jen.Line(),
+		jen.Comment("acceptedEncoding returns the first of the recorded encoding, gzip and deflate accepted by Accept-Encoding."),
+		jen.Line(),
+		jen.Func().Id("acceptedEncoding").Params(jen.Id("accept"), jen.Id("recorded").String()).String().Block(
+			jen.Id("qualities").Op(":=").Make(jen.Map(jen.String()).Float64()),
+			jen.For(jen.List(jen.Id("_"), jen.Id("v")).Op(":=").Range().Qual("strings", "Split").Call(jen.Id("accept"), jen.Lit(","))).Block(
+				jen.Id("parts").Op(":=").Qual("strings", "Split").Call(jen.Id("v"), jen.Lit(";")),
+				jen.Id("q").Op(":=").Lit(1.0),
+				jen.For(jen.List(jen.Id("_"), jen.Id("param")).Op(":=").Range().Id("parts").Index(jen.Lit(1), jen.Empty())).Block(
+					jen.If(jen.Id("param").Op("=").Qual("strings", "TrimSpace").Call(jen.Id("param")), jen.Qual("strings", "HasPrefix").Call(jen.Id("param"), jen.Lit("q="))).Block(
+						jen.List(jen.Id("q"), jen.Id("_")).Op("=").Qual("strconv", "ParseFloat").Call(jen.Id("param").Index(jen.Lit(2), jen.Empty()), jen.Lit(64)),
+					),
+				),
+				jen.Id("qualities").Index(jen.Qual("strings", "ToLower").Call(jen.Qual("strings", "TrimSpace").Call(jen.Id("parts").Index(jen.Lit(0))))).Op("=").Id("q"),
+			),
+			jen.Comment("multiple encodings are not reproduced, so the outermost one is used"),
+			jen.Id("codings").Op(":=").Qual("strings", "Split").Call(jen.Id("recorded"), jen.Lit(",")),
+			jen.Id("preferred").Op(":=").Qual("strings", "ToLower").Call(jen.Qual("strings", "TrimSpace").Call(jen.Id("codings").Index(jen.Len(jen.Id("codings")).Op("-").Lit(1)))),
+			jen.If(jen.Id("preferred").Op("==").Lit("x-gzip")).Block(
+				jen.Id("preferred").Op("=").Lit("gzip"),
+			),
+			jen.For(jen.List(jen.Id("_"), jen.Id("encoding")).Op(":=").Range().Index().String().Values(jen.Id("preferred"), jen.Lit("gzip"), jen.Lit("deflate"))).Block(
+				jen.If(jen.List(jen.Id("q"), jen.Id("ok")).Op(":=").Id("qualities").Index(jen.Id("encoding")), jen.Id("ok")).Block(
+					jen.If(jen.Id("q").Op(">").Lit(0)).Block(
+						jen.Return(jen.Id("encoding")),
+					),
+					jen.Continue(),
+				),
+				jen.If(jen.List(jen.Id("q"), jen.Id("ok")).Op(":=").Id("qualities").Index(jen.Lit("*")), jen.Id("ok").Op("&&").Id("q").Op(">").Lit(0)).Block(
+					jen.Return(jen.Id("encoding")),
+				),
+			),
+			jen.Return(jen.Lit("identity")),
+		),
+		jen.Line(),
+	}
+}
+
+func generateStreamChunks() []jen.Code {
+	return []jen.Code{
+		jen.Type().Id("streamChunk").Struct(
+			jen.Id("Delay").Qual("time", "Duration"),
+			jen.Id("Data").String(),
+		),
+		jen.Line(),
+		jen.Comment("streamChunks writes each chunk after the recorded interval and flushes it."),
+		jen.Line(),
+		jen.Func().Id("streamChunks").Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("chunks").Index().Id("streamChunk")).Block(
+			jen.List(jen.Id("flusher"), jen.Id("_")).Op(":=").Id("rw").Assert(jen.Qual("net/http", "Flusher")),
+			jen.For(jen.List(jen.Id("_"), jen.Id("c")).Op(":=").Range().Id("chunks")).Block(
+				jen.Qual("time", "Sleep").Call(jen.Id("c").Dot("Delay")),
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Qual("fmt", "Fprint").Call(jen.Id("rw"), jen.Id("c").Dot("Data")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(),
+				),
+				jen.If(jen.Id("flusher").Op("!=").Nil()).Block(
+					jen.Id("flusher").Dot("Flush").Call(),
+				),
+			),
+		),
+		jen.Line(),
+	}
+}
+
+func generateServeWebSocket() []jen.Code {
+	ws := jen.Op("*").Qual("golang.org/x/net/websocket", "Conn")
+	receive := func() jen.Code {
+		return jen.If(jen.Err().Op(":=").Qual("golang.org/x/net/websocket", "Message").Dot("Receive").Call(jen.Id("ws"), jen.Op("&").Id("received")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(),
+		)
+	}
+	send := func(m jen.Code) jen.Code {
+		return jen.If(jen.Err().Op(":=").Id("sendWebSocketMessage").Call(jen.Id("ws"), m), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(),
+		)
+	}
+	return []jen.Code{
+		jen.Type().Id("webSocketMessage").Struct(
+			jen.Id("FromClient").Bool(),
+			jen.Id("Binary").Bool(),
+			jen.Id("Data").String(),
+		),
+		jen.Line(),
+		jen.Comment("serveWebSocket upgrades the connection and replays the recorded messages according to -websocket."),
+		jen.Line(),
+		jen.Func().Id("serveWebSocket").Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Op("*").Qual("net/http", "Request"), jen.Id("script").Index().Id("webSocketMessage")).Block(
+			jen.Qual("golang.org/x/net/websocket", "Server").Values(jen.Dict{
+				jen.Id("Handler"): jen.Func().Params(jen.Id("ws").Add(ws)).Block(
+					jen.Defer().Id("ws").Dot("Close").Call(),
+					jen.If(jen.Op("*").Id("webSocketMode").Op("==").Lit("keyed")).Block(
+						jen.Id("replayWebSocketKeyed").Call(jen.Id("ws"), jen.Id("script")),
+						jen.Return(),
+					),
+					jen.Var().Id("received").Index().Byte(),
+					jen.For(jen.List(jen.Id("_"), jen.Id("m")).Op(":=").Range().Id("script")).Block(
+						jen.If(jen.Id("m").Dot("FromClient")).Block(
+							receive(),
+							jen.Continue(),
+						),
+						send(jen.Id("m")),
+					),
+					jen.Comment("keep the connection until the client closes it"),
+					jen.For().Block(
+						receive(),
+					),
+				),
+			}).Dot("ServeHTTP").Call(jen.Id("rw"), jen.Id("r")),
+		),
+		jen.Line(),
+		jen.Comment("replayWebSocketKeyed replies the server messages recorded after the same client message."),
+		jen.Line(),
+		jen.Func().Id("replayWebSocketKeyed").Params(jen.Id("ws").Add(ws), jen.Id("script").Index().Id("webSocketMessage")).Block(
+			jen.Id("i").Op(":=").Lit(0),
+			jen.For(jen.Empty(), jen.Id("i").Op("<").Len(jen.Id("script")).Op("&&").Op("!").Id("script").Index(jen.Id("i")).Dot("FromClient"), jen.Id("i").Op("++")).Block(
+				send(jen.Id("script").Index(jen.Id("i"))),
+			),
+			jen.Id("replies").Op(":=").Make(jen.Map(jen.String()).Index().Id("webSocketMessage")),
+			jen.Var().Id("key").String(),
+			jen.For(jen.List(jen.Id("_"), jen.Id("m")).Op(":=").Range().Id("script").Index(jen.Id("i").Op(":"))).Block(
+				jen.If(jen.Id("m").Dot("FromClient")).Block(
+					jen.Id("key").Op("=").Id("m").Dot("Data"),
+					jen.Continue(),
+				),
+				jen.Id("replies").Index(jen.Id("key")).Op("=").Append(jen.Id("replies").Index(jen.Id("key")), jen.Id("m")),
+			),
+			jen.For().Block(
+				jen.Var().Id("received").Index().Byte(),
+				receive(),
+				jen.For(jen.List(jen.Id("_"), jen.Id("m")).Op(":=").Range().Id("replies").Index(jen.String().Call(jen.Id("received")))).Block(
+					send(jen.Id("m")),
+				),
+			),
+		),
+		jen.Line(),
+		jen.Func().Id("sendWebSocketMessage").Params(jen.Id("ws").Add(ws), jen.Id("m").Id("webSocketMessage")).Error().Block(
+			jen.If(jen.Id("m").Dot("Binary")).Block(
+				jen.Return(jen.Qual("golang.org/x/net/websocket", "Message").Dot("Send").Call(jen.Id("ws"), jen.Index().Byte().Call(jen.Id("m").Dot("Data")))),
+			),
+			jen.Return(jen.Qual("golang.org/x/net/websocket", "Message").Dot("Send").Call(jen.Id("ws"), jen.Id("m").Dot("Data"))),
 		),
 		jen.Line(),
 	}
@@ -2,12 +2,20 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/dave/jennifer/jen"
 	"github.com/stretchr/testify/assert"
 )
@@ -58,7 +66,7 @@ func TestGenerateMain(t *testing.T) {
 				if q, _ := stringifyUrlValues(r.URL.Query()); q == "{}" {
 					if body == "{\"token\":\"abc\"}" {
 						rw.WriteHeader(200)
-						fmt.Fprint(rw, "{\"foo\":\"bar\"}")
+						fmt.Fprint(rw, "{\"foo\": \"bar\"}")
 						return
 					}
 				}
@@ -81,7 +89,7 @@ func TestGenerateMain(t *testing.T) {
 					if body == "" {
 						rw.Header().Set("X-Foo", "foo")
 						rw.WriteHeader(200)
-						fmt.Fprint(rw, "{\"foo\":\"bar\"}")
+						fmt.Fprint(rw, "{\"foo\": \"bar\"}")
 						return
 					}
 				}
@@ -104,7 +112,8 @@ func TestGenerateMain(t *testing.T) {
 func TestStringify(t *testing.T) {
 	generated := jen.Statement(generateStringify())
 	assert.Equal(t,
-		`func stringify(r io.ReadCloser) (string, error) {
+		`// stringify canonicalizes a JSON body (sorted keys, no spaces, numbers as is) and returns other bodies as is.
+func stringify(r io.ReadCloser) (string, error) {
 	if r == nil {
 		return "", nil
 	}
@@ -113,11 +122,16 @@ func TestStringify(t *testing.T) {
 		return "", err
 	}
 	defer r.Close()
-	bm := make(map[string]interface{})
-	if err := json.Unmarshal(body, &bm); err != nil {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
 		return string(body), err
 	}
-	if j, err := json.Marshal(bm); err != nil {
+	if _, err := d.Token(); err != io.EOF {
+		return string(body), fmt.Errorf("invalid JSON: unexpected data after top-level value")
+	}
+	if j, err := json.Marshal(v); err != nil {
 		return string(body), err
 	} else {
 		return string(j), nil
@@ -150,3 +164,739 @@ func TestGenerateEnableLogRequest(t *testing.T) {
 } 
 `, fmt.Sprintf("%#v", &generated))
 }
+
+func resetGenerator() {
+	resetTree()
+	mockServerPort = 8080
+	externalAPIToMockServerMap = make(map[string]int)
+	generatedFlags = make(map[string]jen.Code)
+}
+
+// 生成したコードをファイルとしてレンダリングする(構文エラーがあればエラーになる)
+func renderFile(t *testing.T, root SyntaxNode) string {
+	t.Helper()
+	f := jen.NewFile("main")
+	f.Add(generate(root))
+	var buf bytes.Buffer
+	assert.NoError(t, f.Render(&buf))
+	return buf.String()
+}
+
+func TestGenerateMatchHeader(t *testing.T) {
+	resetGenerator()
+	matchHeaders = []string{"X-Tenant-Id"}
+	defer func() {
+		matchHeaders = nil
+	}()
+	flows := map[string]Flow{}
+	for i, tenant := range []string{"a", "b"} {
+		flows[fmt.Sprint(i)] = Flow{
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Path: "/"},
+				Header: http.Header{
+					"X-Tenant-Id": []string{tenant},
+					"User-Agent":  []string{"test" + tenant},
+				},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte(tenant))),
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `var matchHeaders = []string{"X-Tenant-Id"}`)
+	assert.Contains(t, code, `if h, _ := stringifySelectedHeader(r.Header, matchHeaders); h == "{\"X-Tenant-Id\":[\"a\"]}" {
+						if body == "" {
+							rw.WriteHeader(200)
+							fmt.Fprint(rw, "a")
+							return
+						}
+					}
+					if h, _ := stringifySelectedHeader(r.Header, matchHeaders); h == "{\"X-Tenant-Id\":[\"b\"]}" {`)
+}
+
+func TestGenerateReplay(t *testing.T) {
+	resetGenerator()
+	started := time.Date(2022, time.August, 1, 0, 0, 0, 0, time.UTC)
+	flows := map[string]Flow{}
+	for i, status := range []string{"pending", "pending", "done"} {
+		flows[fmt.Sprint(i)] = Flow{
+			ID:        fmt.Sprint(i),
+			StartedAt: started.Add(time.Duration(i) * time.Second),
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Path: "/job"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte(status))),
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `func nextResponse(key string, n int) int {`)
+	assert.Contains(t, code, `func main() {
+	flag.Parse()`)
+	assert.Contains(t, code, `if body == "" {
+						switch nextResponse("1", 3) {
+						case 0, 1:
+							rw.WriteHeader(200)
+							fmt.Fprint(rw, "pending")
+							return
+						case 2:
+							rw.WriteHeader(200)
+							fmt.Fprint(rw, "done")
+							return
+						}
+					}`)
+}
+
+func TestStubReplay(t *testing.T) {
+	resetGenerator()
+	// ボディは読み切られるのでスタブごとにフローを作る
+	flows := func() map[string]Flow {
+		flows := map[string]Flow{}
+		for i, status := range []string{"pending", "done"} {
+			flows[fmt.Sprint(i)] = Flow{
+				ID:        fmt.Sprint(i),
+				StartedAt: time.Unix(int64(i), 0),
+				Request: http.Request{
+					Method: "GET",
+					Host:   "localhost:8080",
+					URL:    &url.URL{Scheme: "http", Path: "/job"},
+				},
+				Response: http.Response{
+					StatusCode: 200,
+					Body:       io.NopCloser(bytes.NewReader([]byte(status))),
+				},
+			}
+		}
+		return flows
+	}
+	// 記録された順に返して最後のレスポンスを返し続ける
+	base := runStub(t, flows())
+	for _, expected := range []string{"pending", "done", "done"} {
+		status, body := stubGet(t, base+"/job")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, expected, body)
+	}
+
+	base = runStub(t, flows(), "-replay", "cycle")
+	for _, expected := range []string{"pending", "done", "pending"} {
+		_, body := stubGet(t, base+"/job")
+		assert.Equal(t, expected, body)
+	}
+}
+
+func TestGenerateUpstreamFailure(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{}
+	for _, kind := range []string{upstreamErrorTimeout, upstreamErrorRefused, upstreamErrorDNS} {
+		flows[kind] = Flow{
+			ID: kind,
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Path: "/" + kind},
+			},
+			Error: kind,
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `timeoutDelay = flag.Duration("timeoutDelay", time.Minute, "delay before closing the connection for requests whose upstream timed out")`)
+	assert.Contains(t, code, `mux.HandleFunc("/timeout", func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := stringify(r.Body)
+			if r.Method == "GET" {
+				if q, _ := stringifyUrlValues(r.URL.Query()); q == "{}" {
+					if body == "" {
+						time.Sleep(*timeoutDelay)
+						panic(http.ErrAbortHandler)
+					}`)
+	assert.Contains(t, code, `if body == "" {
+						panic(http.ErrAbortHandler)
+					}`)
+	assert.Contains(t, code, `if body == "" {
+						rw.WriteHeader(http.StatusBadGateway)
+						return
+					}`)
+}
+
+func TestGenerateLatency(t *testing.T) {
+	resetGenerator()
+	latencyMode = "p95"
+	defer func() { latencyMode = "off" }()
+	flows := map[string]Flow{}
+	for i, wait := range []time.Duration{300 * time.Millisecond, 100 * time.Millisecond} {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/foo", RawQuery: "id=" + id},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+			Wait:    wait,
+			Receive: 20 * time.Millisecond,
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `latencyMode = flag.String("latency", "p95", `)
+	assert.Contains(t, code, `var latencySamples = map[string][]time.Duration{"GET http://localhost:8080/foo": {120 * time.Millisecond, 320 * time.Millisecond}}`)
+	assert.Contains(t, code, `delay("GET http://localhost:8080/foo", 320*time.Millisecond)`)
+	assert.Contains(t, code, `delay("GET http://localhost:8080/foo", 120*time.Millisecond)`)
+}
+
+func TestGenerateHTTP2(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{}
+	for i, host := range []string{"https://secure.example.com/", "http://plain.example.com/"} {
+		u, _ := url.Parse(host)
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID: id,
+			Request: http.Request{
+				Method: "GET",
+				Host:   u.Host,
+				URL:    u,
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Proto:      "HTTP/2.0",
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `Handler: h2c.NewHandler(enableLogRequest(mux, port), &http2.Server{}),`)
+	assert.Contains(t, code, `http2.ConfigureServer(&server, &http2.Server{})
+		go server.ListenAndServeTLS("cert.pem", "key.pem")`)
+}
+
+func TestGenerateWebSocket(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/ws"},
+			},
+			Response: http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				Header:     http.Header{"Upgrade": []string{"websocket"}},
+			},
+			Messages: []WebSocketMessage{
+				{From: webSocketFromServer, Data: []byte("welcome")},
+				{From: webSocketFromClient, Data: []byte(`{"op":"subscribe"}`)},
+				{From: webSocketFromServer, Binary: true, Data: []byte{0x00, 0xff}},
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `webSocketMode = flag.String("websocket", "script", `)
+	assert.Contains(t, code, `if body == "" {
+						serveWebSocket(rw, r, []webSocketMessage{
+							{Data: "welcome"},
+							{
+								Data:       "{\"op\":\"subscribe\"}",
+								FromClient: true,
+							},
+							{
+								Binary: true,
+								Data:   "\x00\xff",
+							},
+						})
+						return
+					}`)
+	assert.Contains(t, code, `func replayWebSocketKeyed(ws *websocket.Conn, script []webSocketMessage) {`)
+}
+
+func TestGenerateStream(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/events"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+				Body:       io.NopCloser(bytes.NewReader([]byte("data: 1\n\ndata: 2\n\n"))),
+			},
+			Wait: 50 * time.Millisecond,
+			Chunks: []BodyChunk{
+				{At: 60 * time.Millisecond, Size: 9},
+				{At: 560 * time.Millisecond, Size: 9},
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `streamChunks(rw, []streamChunk{
+							{
+								Data:  "data: 1\n\n",
+								Delay: 10 * time.Millisecond,
+							},
+							{
+								Data:  "data: 2\n\n",
+								Delay: 500 * time.Millisecond,
+							},
+						})`)
+	assert.Contains(t, code, `func streamChunks(rw http.ResponseWriter, chunks []streamChunk) {`)
+}
+
+func TestGenerateContentEncoding(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/echo"},
+				Header: http.Header{"Content-Encoding": []string{"gzip"}},
+				Body:   io.NopCloser(bytes.NewReader([]byte(`{"foo":"bar"}`))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+				Body:       io.NopCloser(bytes.NewReader([]byte(`{"foo":"bar"}`))),
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `body, _ := stringify(decodeBody(r))`)
+	assert.Contains(t, code, `if body == "{\"foo\":\"bar\"}" {
+						writeEncoded(rw, r, 200, "gzip", "{\"foo\":\"bar\"}")
+						return
+					}`)
+	assert.NotContains(t, code, `rw.Header().Set("Content-Encoding", "gzip")`)
+	// brを記録していなければbrotliのパッケージは使わない
+	assert.NotContains(t, code, `brotli`)
+}
+
+func TestGenerateBrotli(t *testing.T) {
+	resetGenerator()
+	var br bytes.Buffer
+	w := brotli.NewWriter(&br)
+	io.WriteString(w, `{"foo":"bar"}`)
+	w.Close()
+	header := http.Header{"Content-Encoding": []string{"br"}}
+	body, undecoded := decodeBody(header, br.Bytes())
+	assert.Equal(t, `{"foo":"bar"}`, string(body))
+	assert.False(t, undecoded)
+
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/echo"},
+				Header: header,
+				Body:   io.NopCloser(bytes.NewReader(body)),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Encoding": []string{"br"}},
+				Body:       io.NopCloser(bytes.NewReader(body)),
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `writeEncoded(rw, r, 200, "br", "{\"foo\":\"bar\"}")`)
+	assert.Contains(t, code, `case "br":
+			decoded = brotli.NewReader(bytes.NewReader(body))`)
+	assert.Contains(t, code, `case "br":
+		w = brotli.NewWriter(rw)`)
+}
+
+func TestStubContentEncoding(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/echo"},
+				Header: http.Header{"Content-Encoding": []string{"gzip, deflate"}},
+				Body:   io.NopCloser(bytes.NewReader([]byte(`{"foo":"bar"}`))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte("matched"))),
+			},
+		},
+	}
+	base := runStub(t, flows)
+	compress := func(w io.WriteCloser) {
+		io.WriteString(w, `{"foo":"bar"}`)
+		w.Close()
+	}
+	var gz, zl, fl bytes.Buffer
+	compress(gzip.NewWriter(&gz))
+	compress(zlib.NewWriter(&zl))
+	w, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	compress(w)
+	var gzZl bytes.Buffer
+	zw := zlib.NewWriter(&gzZl)
+	zw.Write(gz.Bytes())
+	zw.Close()
+	// 記録したときと同じように複数のContent-Encodingや生のdeflateも展開して比較する
+	for encoding, body := range map[string][]byte{
+		"gzip, deflate": gzZl.Bytes(),
+		"GZIP":          gz.Bytes(),
+		"deflate":       fl.Bytes(),
+		" deflate ":     zl.Bytes(),
+	} {
+		req, _ := http.NewRequest("POST", base+"/echo", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		got, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "matched", string(got), encoding)
+	}
+}
+
+func TestGenerateUndecodedBody(t *testing.T) {
+	resetGenerator()
+	header := http.Header{"Content-Encoding": []string{"gzip"}}
+	// 壊れたgzipは展開できないのでそのまま記録する
+	body, undecoded := decodeBody(header, []byte("broken"))
+	assert.Equal(t, "broken", string(body))
+	assert.True(t, undecoded)
+	assert.Equal(t, http.Header{"Content-Encoding": []string{"gzip"}}, header)
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/broken"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Header:     header,
+				Body:       io.NopCloser(bytes.NewReader(body)),
+			},
+			ResponseUndecoded: undecoded,
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `rw.Header().Set("Content-Encoding", "gzip")`)
+	assert.NotContains(t, code, `writeEncoded`)
+}
+
+func TestCreateExternalAPITreeResetsState(t *testing.T) {
+	resetGenerator()
+	latencyMode = "p95"
+	defer func() { latencyMode = "off" }()
+	first := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/echo"},
+				Header: http.Header{"Content-Encoding": []string{"gzip"}, "Content-Type": []string{"application/x-www-form-urlencoded"}},
+				Body:   io.NopCloser(bytes.NewReader([]byte("a=1"))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Proto:      "HTTP/2.0",
+			},
+			Wait: 100 * time.Millisecond,
+		},
+		"2": {
+			ID: "2",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/echo/xml"},
+				Header: http.Header{"Content-Type": []string{"text/xml"}},
+				Body:   io.NopCloser(bytes.NewReader([]byte("<a>1</a>"))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		},
+	}
+	_, err := createExternalAPITree(first)
+	assert.NoError(t, err)
+	second := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/plain"},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+			Wait: 100 * time.Millisecond,
+		},
+	}
+	// 前に作ったツリーの状態は引き継がない
+	o, err := createExternalAPITree(second)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `var latencySamples = map[string][]time.Duration{"GET http://localhost:8080/plain": {100 * time.Millisecond}}`)
+	assert.NotContains(t, code, `echo`)
+	assert.NotContains(t, code, `http2`)
+	assert.NotContains(t, code, `decodeBody`)
+	assert.NotContains(t, code, `stringifyForm`)
+	assert.NotContains(t, code, `stringifyXML`)
+}
+
+func TestGenerateBinaryBody(t *testing.T) {
+	resetGenerator()
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00}
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/image"},
+				Body:   io.NopCloser(bytes.NewReader([]byte{0x08, 0x96, 0x01})),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader(png)),
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `if body == string(binaryBody("CJYB")) {
+						rw.WriteHeader(200)
+						rw.Write(binaryBody("iVBORw0KGgoA"))
+						return
+					}`)
+	assert.Contains(t, code, `func binaryBody(s string) []byte {`)
+	assert.False(t, isBinaryBody("{\"foo\":\"bar\"}\n"))
+	assert.False(t, isBinaryBody("こんにちは"))
+}
+
+func TestGenerateFixture(t *testing.T) {
+	resetGenerator()
+	fixtureThreshold = 8
+	defer func() { fixtureThreshold = 0 }()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/large"},
+				Body:   io.NopCloser(bytes.NewReader([]byte(`{"query":"large"}`))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte(`{"result":"large"}`))),
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `if hashBody(body) == "9bd9f783423d0d8676f9849971034cef4d580cee40ed09eb8e10bf062ec59dcf" {
+						rw.WriteHeader(200)
+						rw.Write(fixture("d83316aaa96a9fa08c75f275ad7b8caf.json"))`)
+	assert.Contains(t, code, "//go:embed fixtures\nvar fixtureFS embed.FS")
+	assert.Equal(t, 1, len(fixtures))
+	for name, body := range fixtures {
+		assert.True(t, strings.HasSuffix(name, ".json"))
+		assert.Equal(t, `{"result":"large"}`, string(body))
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, c := range []struct {
+		body     string
+		expected string
+		valid    bool
+	}{
+		{`{"b": 1, "a": {"d": [3, 2], "c": null}}`, `{"a":{"c":null,"d":[3,2]},"b":1}`, true},
+		{` [ {"id": 2}, {"id": 1} ] `, `[{"id":2},{"id":1}]`, true},
+		{`{"id": 12345678901234567890, "price": 1.50}`, `{"id":12345678901234567890,"price":1.50}`, true},
+		{`"text"`, `"text"`, true},
+		{`{"a":1} trailing`, `{"a":1} trailing`, false},
+		{`not json`, `not json`, false},
+	} {
+		actual, err := canonicalJSON([]byte(c.body))
+		assert.Equal(t, c.expected, actual)
+		assert.Equal(t, c.valid, err == nil, c.body)
+	}
+}
+
+func TestNormalizeForm(t *testing.T) {
+	a, ok := normalizeForm("application/x-www-form-urlencoded", "b=2&a=1&a=3")
+	assert.True(t, ok)
+	b, _ := normalizeForm("application/x-www-form-urlencoded; charset=utf-8", "a=1&b=2&a=3")
+	assert.Equal(t, `{"a":["1","3"],"b":["2"]}`, a)
+	assert.Equal(t, a, b)
+
+	multipartBody := func(boundary string, fields [][2]string) string {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		w.SetBoundary(boundary)
+		for _, f := range fields {
+			if f[0] == "file" {
+				fw, _ := w.CreateFormFile(f[0], "upload.png")
+				io.WriteString(fw, f[1])
+			} else {
+				w.WriteField(f[0], f[1])
+			}
+		}
+		w.Close()
+		return buf.String()
+	}
+	c, ok := normalizeForm("multipart/form-data; boundary=aaa", multipartBody("aaa", [][2]string{{"name", "foo"}, {"file", "content"}}))
+	assert.True(t, ok)
+	d, _ := normalizeForm("multipart/form-data; boundary=bbb", multipartBody("bbb", [][2]string{{"file", "content"}, {"name", "foo"}}))
+	assert.Equal(t, `{"file":["sha256:ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"],"name":["foo"]}`, c)
+	assert.Equal(t, c, d)
+
+	_, ok = normalizeForm("application/json", `{"a":1}`)
+	assert.False(t, ok)
+}
+
+func TestGenerateFormBody(t *testing.T) {
+	resetGenerator()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/login"},
+				Header: http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}},
+				Body:   io.NopCloser(bytes.NewReader([]byte("user=foo&password=bar"))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `body, _ := stringify(r.Body)
+			body = stringifyForm(r.Header.Get("Content-Type"), body)`)
+	assert.Contains(t, code, `if body == "{\"password\":[\"bar\"],\"user\":[\"foo\"]}" {`)
+	assert.Contains(t, code, `func stringifyForm(contentType, body string) string {`)
+}
+
+func TestGenerateXMLBody(t *testing.T) {
+	resetGenerator()
+	soapMatch = "operation"
+	defer func() { soapMatch = "body" }()
+	flows := map[string]Flow{
+		"1": {
+			ID: "1",
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/soap"},
+				Header: http.Header{
+					"Content-Type": []string{"text/xml; charset=utf-8"},
+					"Soapaction":   []string{`"urn:stock#GetPrice"`},
+				},
+				Body: io.NopCloser(bytes.NewReader([]byte(`<Envelope><Body><GetPrice/></Body></Envelope>`))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		},
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `body = stringifyXML(r.Header, body)`)
+	assert.Contains(t, code, `if body == "operation:urn:stock#GetPrice" {`)
+	assert.Contains(t, code, `func soapOperation(header http.Header, body string) string {`)
+}
+
+func TestGenerateIgnoreRules(t *testing.T) {
+	resetGenerator()
+	matchHeaders = []string{"*"}
+	ignoreHeaders = append(append([]string{}, defaultIgnoredHeaders...), "X-Request-Id")
+	ignoreQueries = []string{"_"}
+	ignoreJSONPaths = [][]string{{"nonce"}}
+	defer func() {
+		matchHeaders = nil
+		ignoreHeaders = nil
+		ignoreQueries = nil
+		ignoreJSONPaths = nil
+	}()
+	flows := map[string]Flow{}
+	for i := 0; i < 2; i++ {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: "/order", RawQuery: "item=1&_=" + id},
+				Header: http.Header{
+					"X-Tenant-Id":    []string{"a"},
+					"X-Request-Id":   []string{id},
+					"Content-Length": []string{"30"},
+				},
+				Body: io.NopCloser(bytes.NewReader([]byte(`{"item":1,"nonce":"` + id + `"}`))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	// 揮発するフィールドを除けば同じリクエストになる
+	assert.Contains(t, code, `if q, _ := stringifyUrlValues(r.URL.Query()); q == "{\"item\":[\"1\"]}" {
+					if h, _ := stringifySelectedHeader(r.Header, matchHeaders); h == "{\"X-Tenant-Id\":[\"a\"]}" {
+						if body == "{\"item\":1}" {`)
+	assert.Contains(t, code, `body = ignoreJSONFields(body)`)
+	assert.Contains(t, code, `var ignoreQueries = []string{"_"}`)
+	assert.Contains(t, code, `var ignoreHeaders = []string{"Connection", "Content-Length", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "X-Request-Id"}`)
+	assert.Contains(t, code, `var ignoreJSONPaths = [][]string{{"nonce"}}`)
+}
@@ -3,6 +3,7 @@ module github.com/teru01/gstbgen
 go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/dave/jennifer v1.5.0
 	github.com/elazarl/goproxy v0.0.0-20220529153421-8ea89ba92021
 	github.com/google/uuid v1.3.0
@@ -10,6 +11,7 @@ require (
 	github.com/stretchr/testify v1.8.0
 	github.com/urfave/cli/v2 v2.11.0
 	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -22,5 +24,4 @@ require (
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 	golang.org/x/text v0.3.7 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
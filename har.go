@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/)
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	// WebSocketのメッセージ(Chromeと同じカスタムフィールド)
+	WebSocketMessages []HARWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	// 外部APIとの通信に失敗した場合のエラー(Chromeと同じカスタムフィールド)
+	Error string `json:"_error,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []HARNameValue `json:"params,omitempty"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARWebSocketMessage struct {
+	// send or receive
+	Type string `json:"type"`
+	// UNIX時間(秒)
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	// opcodeが2(バイナリ)の場合はbase64
+	Data string `json:"data"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// ReadHARFile converts entries of a HAR file into flows.
+func ReadHARFile(path string) (map[string]Flow, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read har file: %w", err)
+	}
+	var har HAR
+	if err := json.Unmarshal(b, &har); err != nil {
+		return nil, fmt.Errorf("failed to parse har file %s: %w", path, err)
+	}
+	flows := make(map[string]Flow)
+	for i, entry := range har.Log.Entries {
+		flow, err := entry.flow(fmt.Sprintf("%s#%d", path, i))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		flows[flow.ID] = flow
+	}
+	return flows, nil
+}
+
+func (e HAREntry) flow(id string) (Flow, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return Flow{}, fmt.Errorf("failed to parse url of entry %s: %w", id, err)
+	}
+	var reqBody []byte
+	if e.Request.PostData != nil {
+		if e.Request.PostData.Text != "" {
+			reqBody = []byte(e.Request.PostData.Text)
+		} else if len(e.Request.PostData.Params) > 0 {
+			params := url.Values{}
+			for _, p := range e.Request.PostData.Params {
+				params.Add(p.Name, p.Value)
+			}
+			reqBody = []byte(params.Encode())
+		}
+	}
+	respBody := []byte(e.Response.Content.Text)
+	if e.Response.Content.Encoding == "base64" {
+		respBody, err = base64.StdEncoding.DecodeString(e.Response.Content.Text)
+		if err != nil {
+			return Flow{}, fmt.Errorf("failed to decode content of entry %s: %w", id, err)
+		}
+	}
+	messages, err := e.webSocketMessages()
+	if err != nil {
+		return Flow{}, fmt.Errorf("failed to decode websocket message of entry %s: %w", id, err)
+	}
+	respHeader := harHeader(e.Response.Headers)
+	// HARのcontentはデコード済みなのでエンコーディング関連のヘッダは捨てる
+	respHeader.Del("Content-Encoding")
+	respHeader.Del("Content-Length")
+	respHeader.Del("Transfer-Encoding")
+	return Flow{
+		ID:        id,
+		StartedAt: e.StartedDateTime,
+		Request: http.Request{
+			Method: e.Request.Method,
+			URL:    u,
+			Host:   u.Host,
+			Proto:  harProto(e.Request.HTTPVersion),
+			Header: harHeader(e.Request.Headers),
+			Body:   io.NopCloser(bytes.NewReader(reqBody)),
+		},
+		Response: http.Response{
+			StatusCode: e.Response.Status,
+			Proto:      harProto(e.Response.HTTPVersion),
+			Header:     respHeader,
+			Body:       io.NopCloser(bytes.NewReader(respBody)),
+		},
+		Wait:     fromMillis(e.Timings.Wait),
+		Receive:  fromMillis(e.Timings.Receive),
+		Error:    harUpstreamError(e.Response.Error),
+		Messages: messages,
+	}, nil
+}
+
+func (e HAREntry) webSocketMessages() ([]WebSocketMessage, error) {
+	var messages []WebSocketMessage
+	for _, m := range e.WebSocketMessages {
+		message := WebSocketMessage{
+			At:     time.Unix(0, int64(m.Time*float64(time.Second))).Sub(e.StartedDateTime),
+			From:   webSocketFromServer,
+			Binary: m.Opcode == wsOpBinary,
+			Data:   []byte(m.Data),
+		}
+		if m.Type == "send" {
+			message.From = webSocketFromClient
+		}
+		if message.Binary {
+			data, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				return nil, err
+			}
+			message.Data = data
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// Chromeのnet::ERR_*もエラーの種類に変換する
+func harUpstreamError(e string) string {
+	switch {
+	case e == "":
+		return ""
+	case e == upstreamErrorDNS || strings.Contains(e, "NAME_NOT_RESOLVED"):
+		return upstreamErrorDNS
+	case e == upstreamErrorRefused || strings.Contains(e, "CONNECTION_REFUSED"):
+		return upstreamErrorRefused
+	case e == upstreamErrorTimeout || strings.Contains(e, "TIMED_OUT"):
+		return upstreamErrorTimeout
+	case e == upstreamErrorTLS || strings.Contains(e, "SSL") || strings.Contains(e, "CERT"):
+		return upstreamErrorTLS
+	}
+	return upstreamErrorOther
+}
+
+func harHeader(nvs []HARNameValue) http.Header {
+	h := http.Header{}
+	for _, nv := range nvs {
+		// HTTP/2の疑似ヘッダ(:authorityなど)は除外する
+		if strings.HasPrefix(nv.Name, ":") {
+			continue
+		}
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+// NewHAR converts flows into a HAR log ordered by start time.
+// Bodies of the flows are read and replaced so that they can be read again.
+func NewHAR(flows map[string]Flow) HAR {
+	entries := make([]HAREntry, 0, len(flows))
+	for _, flow := range sortedFlows(flows) {
+		entries = append(entries, newHAREntry(&flow))
+		flows[flow.ID] = flow
+	}
+	return HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{
+				Name:    "gstbgen",
+				Version: version,
+			},
+			Entries: entries,
+		},
+	}
+}
+
+func WriteHAR(w io.Writer, flows map[string]Flow) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(NewHAR(flows)); err != nil {
+		return fmt.Errorf("failed to write har: %w", err)
+	}
+	return nil
+}
+
+func newHAREntry(flow *Flow) HAREntry {
+	reqBody := peekBody(&flow.Request.Body)
+	respBody := peekBody(&flow.Response.Body)
+
+	request := HARRequest{
+		Method:      flow.Request.Method,
+		HTTPVersion: harHTTPVersion(flow.Request.Proto),
+		Cookies:     []HARNameValue{},
+		Headers:     harNameValues(flow.Request.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(reqBody),
+	}
+	if flow.Request.URL != nil {
+		request.URL = flow.Request.URL.String()
+		request.QueryString = harNameValues(flow.Request.URL.Query())
+	}
+	for _, c := range flow.Request.Cookies() {
+		request.Cookies = append(request.Cookies, HARNameValue{Name: c.Name, Value: c.Value})
+	}
+	if len(reqBody) > 0 {
+		request.PostData = &HARPostData{
+			MimeType: flow.Request.Header.Get("Content-Type"),
+			Text:     string(reqBody),
+		}
+	}
+
+	content := HARContent{
+		Size:     len(respBody),
+		MimeType: flow.Response.Header.Get("Content-Type"),
+	}
+	if utf8.Valid(respBody) {
+		content.Text = string(respBody)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(respBody)
+		content.Encoding = "base64"
+	}
+	response := HARResponse{
+		Status:      flow.Response.StatusCode,
+		StatusText:  http.StatusText(flow.Response.StatusCode),
+		HTTPVersion: harHTTPVersion(flow.Response.Proto),
+		Cookies:     []HARNameValue{},
+		Headers:     harNameValues(flow.Response.Header),
+		Content:     content,
+		RedirectURL: flow.Response.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(respBody),
+		Error:       flow.Error,
+	}
+	for _, c := range flow.Response.Cookies() {
+		response.Cookies = append(response.Cookies, HARNameValue{Name: c.Name, Value: c.Value})
+	}
+
+	var messages []HARWebSocketMessage
+	for _, m := range flow.Messages {
+		message := HARWebSocketMessage{
+			Type:   "receive",
+			Time:   float64(flow.StartedAt.Add(m.At).UnixNano()) / float64(time.Second),
+			Opcode: wsOpText,
+			Data:   string(m.Data),
+		}
+		if m.From == webSocketFromClient {
+			message.Type = "send"
+		}
+		if m.Binary {
+			message.Opcode = wsOpBinary
+			message.Data = base64.StdEncoding.EncodeToString(m.Data)
+		}
+		messages = append(messages, message)
+	}
+
+	return HAREntry{
+		StartedDateTime: flow.StartedAt,
+		Time:            toMillis(flow.Wait + flow.Receive),
+		Request:         request,
+		Response:        response,
+		Timings: HARTimings{
+			Wait:    toMillis(flow.Wait),
+			Receive: toMillis(flow.Receive),
+		},
+		WebSocketMessages: messages,
+	}
+}
+
+func harNameValues(m map[string][]string) []HARNameValue {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	nvs := []HARNameValue{}
+	for _, k := range keys {
+		for _, v := range m[k] {
+			nvs = append(nvs, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
+
+// ブラウザによってはh2やhttp/2.0のように書かれている
+func harProto(version string) string {
+	switch strings.ToLower(version) {
+	case "":
+		return ""
+	case "h2", "http/2", "http/2.0":
+		return "HTTP/2.0"
+	case "h3", "http/3", "http/3.0":
+		return "HTTP/3.0"
+	}
+	return strings.ToUpper(version)
+}
+
+func harHTTPVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// HARでは不明な値は-1になっている
+func fromMillis(ms float64) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testHAR = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "WebInspector", "version": "537.36"},
+    "entries": [
+      {
+        "startedDateTime": "2022-08-01T12:00:00.123+09:00",
+        "time": 12.5,
+        "request": {
+          "method": "POST",
+          "url": "https://example.com/api/login?lang=ja",
+          "httpVersion": "HTTP/2.0",
+          "headers": [
+            {"name": ":authority", "value": "example.com"},
+            {"name": "Content-Type", "value": "application/x-www-form-urlencoded"}
+          ],
+          "queryString": [{"name": "lang", "value": "ja"}],
+          "cookies": [],
+          "postData": {
+            "mimeType": "application/x-www-form-urlencoded",
+            "params": [{"name": "user", "value": "foo"}]
+          },
+          "headersSize": -1,
+          "bodySize": 8
+        },
+        "response": {
+          "status": 200,
+          "statusText": "OK",
+          "httpVersion": "HTTP/2.0",
+          "headers": [
+            {"name": "Content-Encoding", "value": "gzip"},
+            {"name": "X-Foo", "value": "bar"}
+          ],
+          "cookies": [],
+          "content": {"size": 13, "mimeType": "application/json", "text": "eyJmb28iOiJiYXIifQ==", "encoding": "base64"},
+          "redirectURL": "",
+          "headersSize": -1,
+          "bodySize": -1
+        },
+        "cache": {},
+        "timings": {"send": 0.5, "wait": 10, "receive": 2}
+      }
+    ]
+  }
+}`
+
+func TestReadHARFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.har")
+	assert.NoError(t, os.WriteFile(path, []byte(testHAR), 0644))
+	flows, err := ReadHARFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(flows))
+	for _, flow := range flows {
+		assert.Equal(t, "POST", flow.Request.Method)
+		assert.Equal(t, "https", flow.Request.URL.Scheme)
+		assert.Equal(t, "example.com", flow.Request.Host)
+		assert.Equal(t, "/api/login", flow.Request.URL.Path)
+		assert.Equal(t, "ja", flow.Request.URL.Query().Get("lang"))
+		assert.Empty(t, flow.Request.Header.Get(":authority"))
+		reqBody, _ := io.ReadAll(flow.Request.Body)
+		assert.Equal(t, "user=foo", string(reqBody))
+		assert.Equal(t, 200, flow.Response.StatusCode)
+		assert.Empty(t, flow.Response.Header.Get("Content-Encoding"))
+		assert.Equal(t, "bar", flow.Response.Header.Get("X-Foo"))
+		respBody, _ := io.ReadAll(flow.Response.Body)
+		assert.Equal(t, `{"foo":"bar"}`, string(respBody))
+	}
+}
+
+func TestNewHAR(t *testing.T) {
+	u, _ := url.Parse("http://example.com/api/foo?name=hoge")
+	started := time.Date(2022, time.August, 1, 0, 0, 0, 0, time.UTC)
+	flows := map[string]Flow{
+		"2": {
+			ID:        "2",
+			StartedAt: started.Add(time.Second),
+			Request: http.Request{
+				Method: "GET",
+				URL:    u,
+				Host:   u.Host,
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"image/png"}},
+				Body:       io.NopCloser(bytes.NewReader([]byte{0x89, 0x50, 0x4e, 0x47, 0xff})),
+			},
+		},
+		"1": {
+			ID:        "1",
+			StartedAt: started,
+			Request: http.Request{
+				Method: "POST",
+				URL:    u,
+				Host:   u.Host,
+				Header: http.Header{"Content-Type": []string{"application/json"}},
+				Body:   io.NopCloser(bytes.NewReader([]byte(`{"token":"abc"}`))),
+			},
+			Response: http.Response{
+				StatusCode: 404,
+				Body:       io.NopCloser(bytes.NewReader([]byte(`not found`))),
+			},
+			Wait:    10 * time.Millisecond,
+			Receive: 5 * time.Millisecond,
+		},
+	}
+	har := NewHAR(flows)
+	assert.Equal(t, "1.2", har.Log.Version)
+	assert.Equal(t, 2, len(har.Log.Entries))
+
+	first := har.Log.Entries[0]
+	assert.Equal(t, "POST", first.Request.Method)
+	assert.Equal(t, u.String(), first.Request.URL)
+	assert.Equal(t, []HARNameValue{{Name: "name", Value: "hoge"}}, first.Request.QueryString)
+	assert.Equal(t, `{"token":"abc"}`, first.Request.PostData.Text)
+	assert.Equal(t, 404, first.Response.Status)
+	assert.Equal(t, "Not Found", first.Response.StatusText)
+	assert.Equal(t, "not found", first.Response.Content.Text)
+	assert.Equal(t, 15.0, first.Time)
+	assert.Equal(t, 10.0, first.Timings.Wait)
+	assert.Equal(t, 5.0, first.Timings.Receive)
+
+	second := har.Log.Entries[1]
+	assert.Equal(t, "base64", second.Response.Content.Encoding)
+	assert.Equal(t, "iVBOR/8=", second.Response.Content.Text)
+
+	// ボディは再度読める
+	body, _ := io.ReadAll(flows["1"].Response.Body)
+	assert.Equal(t, "not found", string(body))
+
+	// 書き出したHARはそのまま読み込める
+	path := filepath.Join(t.TempDir(), "out.har")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, WriteHAR(f, flows))
+	f.Close()
+	imported, err := ReadHARFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(imported))
+}
@@ -11,12 +11,16 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"net"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/elazarl/goproxy"
+	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/idna"
 )
 
@@ -112,7 +116,7 @@ func createCertificate(host string, rootCertificate *x509.Certificate, rootKey *
 	return tls.X509KeyPair(certPemB, keyPemB)
 }
 
-func enableHttpsProxy(c *cli.Context, proxy *goproxy.ProxyHttpServer) error {
+func enableHttpsProxy(c *cli.Context, proxy *GenProxy) error {
 	certFile, err := os.Open(c.String("cert"))
 	if err != nil {
 		return fmt.Errorf("failed to open cert file: %w", err)
@@ -135,16 +139,42 @@ func enableHttpsProxy(c *cli.Context, proxy *goproxy.ProxyHttpServer) error {
 			fmt.Println(err)
 			return nil, ""
 		}
+		// goproxyのConnectMitmはHTTP/1.1しか扱えないので自前でTLSを終端する
 		customConnectAction := &goproxy.ConnectAction{
-			Action: goproxy.ConnectMitm,
-			TLSConfig: func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
-				var config tls.Config
-				config.Certificates = append(config.Certificates, certificate)
-				return &config, nil
+			Action: goproxy.ConnectHijack,
+			Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				serveMitm(proxy, req.Host, client, &tls.Config{
+					Certificates: []tls.Certificate{certificate},
+					NextProtos:   []string{"h2", "http/1.1"},
+				})
 			},
 		}
 		return customConnectAction, host
 	}
-	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(httpsHandler))
+	proxy.Proxy().OnRequest().HandleConnect(goproxy.FuncHttpsHandler(httpsHandler))
 	return nil
 }
+
+// クライアントとALPNでh2かHTTP/1.1をネゴシエートし、復号したリクエストをプロキシに渡す
+func serveMitm(proxy http.Handler, host string, client net.Conn, config *tls.Config) {
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	conn := tls.Server(client, config)
+	if err := conn.Handshake(); err != nil {
+		log.Warn().Err(err).Msgf("cannot handshake client %s", host)
+		return
+	}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		r.URL.Host = host
+		proxy.ServeHTTP(rw, r)
+	})
+	if conn.ConnectionState().NegotiatedProtocol == "h2" {
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		return
+	}
+	server := &http.Server{Handler: handler}
+	server.Serve(newSingleConnListener(conn))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// matchHeaderに"*"を指定した場合でも比較しない通信のためのヘッダ
+var defaultIgnoredHeaders = []string{"Connection", "Content-Length", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"}
+
+// "$.meta.timestamp"や"$.items[*].nonce"のようなJSONPathをキーの列にする
+// "*"は全てのキーまたは要素にマッチする
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid JSON path %q: must start with $", path)
+	}
+	var segments []string
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: empty key", path)
+			}
+			segments = append(segments, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: unclosed bracket", path)
+			}
+			segment := strings.Trim(rest[1:end], `'"`)
+			if segment == "" {
+				return nil, fmt.Errorf("invalid JSON path %q: empty key", path)
+			}
+			segments = append(segments, segment)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSON path %q", path)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("invalid JSON path %q: root cannot be ignored", path)
+	}
+	return segments, nil
+}
+
+// JSONのボディからignoreJSONPathsのフィールドを除く
+// JSONでないボディはそのまま返す
+func ignoreJSONFields(body string) string {
+	if len(ignoreJSONPaths) == 0 {
+		return body
+	}
+	d := json.NewDecoder(bytes.NewReader([]byte(body)))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return body
+	}
+	for _, path := range ignoreJSONPaths {
+		removeJSONPath(v, path)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return string(j)
+}
+
+// 配列の要素は位置が変わらないようにnullにする
+func removeJSONPath(v interface{}, path []string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if path[0] != "*" && path[0] != k {
+				continue
+			}
+			if len(path) == 1 {
+				delete(t, k)
+			} else {
+				removeJSONPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range t {
+			if path[0] != "*" && path[0] != strconv.Itoa(i) {
+				continue
+			}
+			if len(path) == 1 {
+				t[i] = nil
+			} else {
+				removeJSONPath(child, path[1:])
+			}
+		}
+	}
+}
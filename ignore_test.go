@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	path, err := parseJSONPath("$.items[*].nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"items", "*", "nonce"}, path)
+	path, err = parseJSONPath("$['meta'].requestId")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"meta", "requestId"}, path)
+
+	for _, invalid := range []string{"", "$", "meta.timestamp", "$.", "$.items[0", "$..a"} {
+		_, err := parseJSONPath(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestIgnoreJSONFields(t *testing.T) {
+	ignoreJSONPaths = [][]string{{"timestamp"}, {"items", "*", "nonce"}, {"list", "1"}}
+	defer func() { ignoreJSONPaths = nil }()
+	assert.Equal(t,
+		`{"id":12345678901234567890,"items":[{"name":"a"},{"name":"b"}],"list":[1,null,3]}`,
+		ignoreJSONFields(`{"id":12345678901234567890,"timestamp":"2022-01-01T00:00:00Z","items":[{"name":"a","nonce":"x"},{"name":"b","nonce":"y"}],"list":[1,2,3]}`),
+	)
+	assert.Equal(t, "not json", ignoreJSONFields("not json"))
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,55 +21,68 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// goreleaserのldflagsで上書きされる
+var version = "dev"
+
 type GenProxy struct {
-	proxy *goproxy.ProxyHttpServer
-	flows *Flowsx
+	proxy   *goproxy.ProxyHttpServer
+	flows   *Flowsx
+	capture *CaptureWriter
 }
 
 func main() {
 	app := &cli.App{
-		Flags: []cli.Flag{
-			&cli.StringFlag{
-				Name:    "host",
-				Aliases: []string{"H"},
-				Value:   "0.0.0.0",
-				Usage:   "listening host",
-			},
-			&cli.IntFlag{
-				Name:    "port",
-				Aliases: []string{"p"},
-				Value:   8888,
-				Usage:   "listening port",
-			},
-			&cli.BoolFlag{
-				Name:    "debug",
-				Aliases: []string{"d"},
-				Value:   false,
-				Usage:   "enable debug log",
+		Flags:   append(append(commonFlags(), proxyFlags()...), generateFlags()...),
+		Name:    "gstbgen",
+		Usage:   "Stub generator for system analysis written in Go.",
+		Version: version,
+		Action:  start,
+		Commands: []*cli.Command{
+			{
+				Name:   "record",
+				Usage:  "record flows into a capture file without generating code",
+				Flags:  append(commonFlags(), proxyFlags()...),
+				Action: record,
 			},
-			&cli.IntFlag{
-				Name:    "mockBeginPort",
-				Aliases: []string{"m"},
-				Value:   8080,
-				Usage:   "begin port of generated mock server",
+			{
+				Name:  "generate",
+				Usage: "generate stub server code from capture files, HAR files or OpenAPI documents",
+				Flags: append(append(commonFlags(), generateFlags()...),
+					&cli.StringSliceFlag{
+						Name:    "from",
+						Aliases: []string{"f"},
+						Usage:   "capture file path(can be specified multiple times)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "har",
+						Usage: "HAR file path(can be specified multiple times)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "openapi",
+						Usage: "OpenAPI 3 document path(can be specified multiple times)",
+					},
+				),
+				Action: generateFromCapture,
 			},
-			&cli.StringFlag{
-				Name:  "cert",
-				Usage: "certificate path",
-			},
-			&cli.StringFlag{
-				Name:  "key",
-				Usage: "certificate key path",
-			},
-			&cli.StringFlag{
-				Name:    "out",
-				Aliases: []string{"o"},
-				Usage:   "generated stub server code path(default: stdout)",
+			{
+				Name:  "har",
+				Usage: "convert capture files into a HAR file",
+				Flags: append(commonFlags(),
+					&cli.StringSliceFlag{
+						Name:     "from",
+						Aliases:  []string{"f"},
+						Usage:    "capture file path(can be specified multiple times)",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:    "out",
+						Aliases: []string{"o"},
+						Usage:   "HAR file path(default: stdout)",
+					},
+				),
+				Action: exportHAR,
 			},
 		},
-		Name:   "gstbgen",
-		Usage:  "Stub generator for system analysis written in Go.",
-		Action: start,
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -76,58 +90,412 @@ func main() {
 	}
 }
 
+func commonFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "debug",
+			Aliases: []string{"d"},
+			Value:   false,
+			Usage:   "enable debug log",
+		},
+	}
+}
+
+func proxyFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "host",
+			Aliases: []string{"H"},
+			Value:   "0.0.0.0",
+			Usage:   "listening host",
+		},
+		&cli.IntFlag{
+			Name:    "port",
+			Aliases: []string{"p"},
+			Value:   8888,
+			Usage:   "listening port",
+		},
+		&cli.IntFlag{
+			Name:  "socksPort",
+			Usage: "listening port of SOCKS5 proxy(disabled if not specified)",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "certificate path",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "certificate key path",
+		},
+		&cli.StringFlag{
+			Name:    "capture",
+			Aliases: []string{"c"},
+			Usage:   "capture file path to append recorded flows(JSON Lines)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "upstream",
+			Usage: "run as a reverse proxy to the upstream: <listening port>=<url> or <host>=<url>(can be specified multiple times)",
+		},
+		&cli.StringFlag{
+			Name:  "harOut",
+			Usage: "HAR file path to export recorded flows at shutdown",
+		},
+	}
+}
+
+func generateFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:    "mockBeginPort",
+			Aliases: []string{"m"},
+			Value:   8080,
+			Usage:   "begin port of generated mock server",
+		},
+		&cli.StringFlag{
+			Name:    "out",
+			Aliases: []string{"o"},
+			Usage:   "generated stub server code path(default: stdout)",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "go",
+			Usage: "output format: go(stub server code) or openapi(OpenAPI 3 document per host)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "matchHeader",
+			Usage: "request header name used to match requests in generated stub(can be specified multiple times)",
+		},
+		&cli.StringFlag{
+			Name:  "latency",
+			Value: "off",
+			Usage: "default latency mode of generated stub: off, recorded or a percentile of the route such as p50, p95",
+		},
+		&cli.StringFlag{
+			Name:  "websocket",
+			Value: "script",
+			Usage: "default replay mode of websocket messages in generated stub: script or keyed",
+		},
+		&cli.StringFlag{
+			Name:  "soapMatch",
+			Value: "body",
+			Usage: "how to match SOAP requests in generated stub: body(canonicalized XML) or operation(SOAPAction or the first element in Body)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ignoreXMLElement",
+			Usage: "local name of XML element excluded when matching request bodies, such as MessageID(can be specified multiple times)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ignoreJSONPath",
+			Usage: "JSON path of request body field excluded from matching in generated stub, such as $.meta.timestamp or $.items[*].nonce(can be specified multiple times)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ignoreQuery",
+			Usage: "query parameter excluded from matching in generated stub, such as _(can be specified multiple times)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ignoreHeader",
+			Usage: "request header excluded from matching in generated stub, useful with --matchHeader '*'(can be specified multiple times)",
+		},
+		&cli.BoolFlag{
+			Name:  "pathTemplate",
+			Usage: "collapse IDs in paths(numbers, UUIDs and hashes) into templates such as /users/{id}",
+		},
+		&cli.BoolFlag{
+			Name:  "anyPathValue",
+			Usage: "respond to a path value not recorded for a --pathTemplate route with the response of the first recorded value in lexical order instead of --fallback",
+		},
+		&cli.StringSliceFlag{
+			Name:  "pathParamPattern",
+			Usage: "regular expression of a path segment treated as an ID in addition to the defaults(can be specified multiple times)",
+		},
+		&cli.StringFlag{
+			Name:  "fallback",
+			Value: "none",
+			Usage: "default response of generated stub to requests matching no recorded request: none(empty 200), 404 or 501(with the closest recorded requests), nearest(the response of the closest recorded request) or proxy(the response of the upstream, appended to -capture of the stub)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "fallbackResponse",
+			Usage: "response of generated stub to requests of the route matching no recorded request, such as 'GET /users/{id}=404:{\"error\":\"not found\"}'(can be specified multiple times)",
+		},
+		&cli.IntFlag{
+			Name:  "fixtureThreshold",
+			Usage: "write bodies larger than this size in bytes into fixtures directory next to --out and embed them with go:embed(0: disabled)",
+		},
+		&cli.StringFlag{
+			Name:  "replay",
+			Value: "sequential",
+			Usage: "default replay mode of generated stub when the same request got different responses: sequential, cycle or random",
+		},
+	}
+}
+
+// start records flows as a proxy and generates stub code when it exits.
 func start(c *cli.Context) error {
 	initLog(c)
-	mockServerPort = c.Int("mockBeginPort")
+	proxy, err := runProxy(c)
+	if err != nil {
+		return err
+	}
+	return writeStubCode(c, proxy.Flows())
+}
+
+// record only records flows into the capture file.
+func record(c *cli.Context) error {
+	initLog(c)
+	if c.String("capture") == "" {
+		return fmt.Errorf("--capture is required")
+	}
+	_, err := runProxy(c)
+	return err
+}
+
+// exportHAR converts capture files into a HAR file.
+func exportHAR(c *cli.Context) error {
+	initLog(c)
+	flows := make(map[string]Flow)
+	for _, path := range c.StringSlice("from") {
+		captured, err := ReadCaptureFile(path)
+		if err != nil {
+			return err
+		}
+		for id, flow := range captured {
+			flows[id] = flow
+		}
+	}
+	return writeHARFile(c.String("out"), flows)
+}
+
+// generateFromCapture generates stub code from capture files, HAR files and OpenAPI documents without running the proxy.
+func generateFromCapture(c *cli.Context) error {
+	initLog(c)
+	if len(c.StringSlice("from")) == 0 && len(c.StringSlice("har")) == 0 && len(c.StringSlice("openapi")) == 0 {
+		return fmt.Errorf("--from, --har or --openapi is required")
+	}
+	flows := make(map[string]Flow)
+	for _, path := range c.StringSlice("from") {
+		captured, err := ReadCaptureFile(path)
+		if err != nil {
+			return err
+		}
+		for id, flow := range captured {
+			flows[id] = flow
+		}
+	}
+	for _, path := range c.StringSlice("har") {
+		imported, err := ReadHARFile(path)
+		if err != nil {
+			return err
+		}
+		for id, flow := range imported {
+			flows[id] = flow
+		}
+	}
+	for _, path := range c.StringSlice("openapi") {
+		specified, err := ReadOpenAPIFile(path)
+		if err != nil {
+			return err
+		}
+		for id, flow := range specified {
+			flows[id] = flow
+		}
+	}
+	return writeStubCode(c, flows)
+}
+
+// runProxy runs the proxy until it receives a signal.
+func runProxy(c *cli.Context) (*GenProxy, error) {
 	proxy := NewGenProxy()
 	if c.String("cert") != "" && c.String("key") != "" {
-		enableHttpsProxy(c, proxy.Proxy())
+		enableHttpsProxy(c, proxy)
+	}
+	if c.String("capture") != "" {
+		if err := proxy.EnableCapture(c.String("capture")); err != nil {
+			return nil, err
+		}
+		defer proxy.capture.Close()
+	}
+	upstreams, err := ParseUpstreams(c.StringSlice("upstream"))
+	if err != nil {
+		return nil, err
+	}
+	var handler http.Handler = proxy
+	if len(upstreams.Hosts) > 0 {
+		handler = proxy.RouteByHost(upstreams.Hosts, handler)
+	}
+	servers := []*http.Server{
+		{
+			Addr:    c.String("host") + ":" + c.String("port"),
+			Handler: handler,
+		},
 	}
-	svc := http.Server{
-		Addr:    c.String("host") + ":" + c.String("port"),
-		Handler: proxy.Proxy(),
+	// 転送先ごとのポートではリバースプロキシとして待ち受ける
+	for port, upstream := range upstreams.Ports {
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", c.String("host"), port),
+			Handler: proxy.ReverseProxy(upstream),
+		})
+		log.Info().Msgf("reverse proxy %d -> %s", port, upstream)
 	}
 	quit := make(chan struct{})
-	go func(svc *http.Server, quit chan struct{}) {
-		log.Info().Msgf("listening on %v", svc.Addr)
-		if err := svc.ListenAndServe(); err != http.ErrServerClosed {
-			log.Error().Err(err)
+	for _, svc := range servers {
+		go func(svc *http.Server, quit chan struct{}) {
+			log.Info().Msgf("listening on %v", svc.Addr)
+			if err := svc.ListenAndServe(); err != http.ErrServerClosed {
+				log.Error().Err(err)
+			}
+			quit <- struct{}{}
+		}(svc, quit)
+	}
+
+	var socks net.Listener
+	if c.Int("socksPort") != 0 {
+		socks, err = net.Listen("tcp", fmt.Sprintf("%s:%d", c.String("host"), c.Int("socksPort")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen socks: %w", err)
 		}
-		quit <- struct{}{}
-	}(&svc, quit)
+		go func() {
+			log.Info().Msgf("listening socks on %v", socks.Addr())
+			if err := proxy.ServeSocks(socks); err != nil {
+				log.Error().Err(err).Msg("socks proxy stopped")
+			}
+		}()
+	}
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-shutdown
-	if err := svc.Shutdown(context.Background()); err != nil {
-		return fmt.Errorf("failed to shutdown: %w", err)
+	if socks != nil {
+		socks.Close()
+	}
+	for _, svc := range servers {
+		if err := svc.Shutdown(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to shutdown: %w", err)
+		}
+	}
+	for range servers {
+		<-quit
+	}
+	if c.String("harOut") != "" {
+		if err := writeHARFile(c.String("harOut"), proxy.Flows()); err != nil {
+			return nil, err
+		}
 	}
-	root, err := createExternalAPITree(proxy.Flows())
+	return proxy, nil
+}
+
+func writeHARFile(path string, flows map[string]Flow) error {
+	if path == "" {
+		return WriteHAR(os.Stdout, flows)
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer out.Close()
+	return WriteHAR(out, flows)
+}
+
+func writeStubCode(c *cli.Context, flows map[string]Flow) error {
+	mockServerPort = c.Int("mockBeginPort")
+	switch c.String("replay") {
+	case "sequential", "cycle", "random":
+		replayMode = c.String("replay")
+	default:
+		return fmt.Errorf("unknown replay mode: %s", c.String("replay"))
+	}
+	switch c.String("websocket") {
+	case "script", "keyed":
+		webSocketMode = c.String("websocket")
+	default:
+		return fmt.Errorf("unknown websocket mode: %s", c.String("websocket"))
+	}
+	if !isLatencyMode(c.String("latency")) {
+		return fmt.Errorf("unknown latency mode: %s", c.String("latency"))
+	}
+	latencyMode = c.String("latency")
+	switch c.String("soapMatch") {
+	case "body", "operation":
+		soapMatch = c.String("soapMatch")
+	default:
+		return fmt.Errorf("unknown soap match mode: %s", c.String("soapMatch"))
+	}
+	ignoreXMLElements = c.StringSlice("ignoreXMLElement")
+	if !isFallbackMode(c.String("fallback")) {
+		return fmt.Errorf("unknown fallback mode: %s", c.String("fallback"))
+	}
+	fallbackMode = c.String("fallback")
+	responses, err := parseFallbackResponses(c.StringSlice("fallbackResponse"))
+	if err != nil {
+		return err
+	}
+	fallbackResponses = responses
+	pathTemplates = c.Bool("pathTemplate")
+	anyPathValue = c.Bool("anyPathValue")
+	patterns, err := ParsePathParamPatterns(c.StringSlice("pathParamPattern"))
+	if err != nil {
+		return err
+	}
+	pathParamPatterns = patterns
+	fixtureThreshold = c.Int("fixtureThreshold")
+	if fixtureThreshold > 0 && c.String("out") == "" {
+		return fmt.Errorf("--fixtureThreshold requires --out")
+	}
+	matchHeaders = nil
+	ignoreHeaders = nil
+	for _, name := range c.StringSlice("matchHeader") {
+		if name == "*" {
+			ignoreHeaders = append(ignoreHeaders, defaultIgnoredHeaders...)
+		}
+		matchHeaders = append(matchHeaders, http.CanonicalHeaderKey(name))
+	}
+	for _, name := range c.StringSlice("ignoreHeader") {
+		ignoreHeaders = append(ignoreHeaders, http.CanonicalHeaderKey(name))
+	}
+	ignoreQueries = c.StringSlice("ignoreQuery")
+	ignoreJSONPaths = nil
+	for _, p := range c.StringSlice("ignoreJSONPath") {
+		path, err := parseJSONPath(p)
+		if err != nil {
+			return err
+		}
+		ignoreJSONPaths = append(ignoreJSONPaths, path)
+	}
+	root, err := createExternalAPITree(flows)
 	if err != nil {
 		return fmt.Errorf("generate: %w", err)
 	}
-	stmt := generate(root)
-	if stmt != nil {
+	var buf bytes.Buffer
+	switch c.String("format") {
+	case "go":
+		stmt := generate(root)
+		if stmt == nil {
+			return nil
+		}
 		f := jen.NewFile("main")
 		f.Add(stmt)
-		var buf bytes.Buffer
 		if err := f.Render(&buf); err != nil {
 			return fmt.Errorf("faield to render: %w", err)
 		}
-		if c.String("out") == "" {
-			fmt.Println(buf.String())
-		} else {
-			out, err := os.OpenFile(c.String("out"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to open file: %w", err)
-			}
-			if _, err := io.Copy(out, &buf); err != nil {
-				return fmt.Errorf("failed to write file: %w", err)
-			}
+	case "openapi":
+		if err := WriteOpenAPI(&buf, NewOpenAPIDocuments(root)); err != nil {
+			return err
 		}
+	default:
+		return fmt.Errorf("unknown format: %s", c.String("format"))
 	}
-	<-quit
-	return nil
+	if c.String("out") == "" {
+		fmt.Println(buf.String())
+		return nil
+	}
+	out, err := os.OpenFile(c.String("out"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, &buf); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return writeFixtures(c.String("out"))
 }
 
 func initLog(c *cli.Context) {
@@ -147,50 +515,164 @@ func initLog(c *cli.Context) {
 
 func NewGenProxy() *GenProxy {
 	proxy := goproxy.NewProxyHttpServer()
+	// 外部APIともh2で通信できるようにする(TLSClientConfigを指定しているTransportはデフォルトでは無効)
+	proxy.Tr.ForceAttemptHTTP2 = true
 	flows := &Flowsx{
 		Flows: make(map[string]Flow),
 		mutex: sync.Mutex{},
 	}
+	p := &GenProxy{
+		proxy: proxy,
+		flows: flows,
+	}
 	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		flowID := uuid.New().String()
-		var reqBody io.ReadCloser
-		r.Body, reqBody = duplicateReadCloser(r.Body)
-		request := http.Request{
-			URL:    r.URL,
-			Host:   r.Host,
-			Method: r.Method,
-			Body:   reqBody,
-		}
-		ctx.UserData = Flow{
-			ID:      flowID,
-			Request: request,
-		}
+		ctx.UserData = p.begin(r)
+		// 外部APIとの通信に失敗したフローも記録する
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			resp, err := ctx.Proxy.Tr.RoundTrip(req)
+			flow := ctx.UserData.(Flow)
+			if err != nil {
+				p.fail(flow, err)
+				return resp, err
+			}
+			// レスポンスヘッダを受け取るまでの時間(TTFB)
+			flow.Wait = time.Since(flow.StartedAt)
+			ctx.UserData = flow
+			return resp, err
+		})
 		return r, nil
 	})
 
 	proxy.OnResponse().DoFunc(func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-		flow := ctx.UserData.(Flow)
-		var respBody io.ReadCloser
 		if r == nil {
-			log.Warn().Msgf("%s %s", ctx.Req.Method, ctx.Req.URL.String())
+			// 失敗したフローはRoundTripperで記録している
+			log.Debug().Msgf("no response: %s %s", ctx.Req.Method, ctx.Req.URL.String())
 			return r
-		} else {
-			r.Body, respBody = duplicateReadCloser(r.Body)
-		}
-		response := http.Response{
-			StatusCode: r.StatusCode,
-			Header:     r.Header,
-			Body:       respBody,
 		}
-		flow.Response = response
-		flows.add(flow)
-		log.Info().Msgf("%s %s", r.Request.Method, r.Request.URL.String())
+		p.receive(ctx.UserData.(Flow), r)
 		return r
 	})
-	return &GenProxy{
-		proxy: proxy,
-		flows: flows,
+	return p
+}
+
+// リクエストの記録を開始する
+func (p *GenProxy) begin(r *http.Request) Flow {
+	var reqBody io.ReadCloser
+	if r.Body != nil {
+		r.Body, reqBody = duplicateReadCloser(r.Body)
+	}
+	return Flow{
+		ID:        uuid.New().String(),
+		StartedAt: time.Now(),
+		Request: http.Request{
+			URL:    r.URL,
+			Host:   r.Host,
+			Method: r.Method,
+			Proto:  r.Proto,
+			Header: recordedHeader(r.Header),
+			Body:   reqBody,
+		},
+	}
+}
+
+// レスポンスヘッダを受け取った時点で呼ばれ、ボディが読み終わったらフローを完了する
+func (p *GenProxy) receive(flow Flow, r *http.Response) {
+	var chunks *chunkRecorder
+	if isStreamingResponse(r) {
+		chunks = &chunkRecorder{ReadCloser: r.Body, startedAt: flow.StartedAt}
+		r.Body = chunks
+	}
+	var respBody io.ReadCloser
+	r.Body, respBody = duplicateReadCloser(r.Body)
+	flow.Response = http.Response{
+		StatusCode: r.StatusCode,
+		Proto:      r.Proto,
+		Header:     r.Header,
+		Body:       respBody,
+	}
+	if flow.Wait == 0 {
+		flow.Wait = time.Since(flow.StartedAt)
+	}
+	p.flows.add(flow)
+	r.Body = notifyOnClose(r.Body, func() {
+		if chunks != nil {
+			flow.Chunks = chunks.result()
+		}
+		p.complete(flow)
+	})
+	log.Info().Msgf("%s %s", flow.Request.Method, flow.Request.URL.String())
+}
+
+// プロキシ宛てのヘッダは外部APIに送られないので記録しない
+func recordedHeader(h http.Header) http.Header {
+	header := h.Clone()
+	header.Del("Proxy-Connection")
+	header.Del("Proxy-Authorization")
+	header.Del("Proxy-Authenticate")
+	return header
+}
+
+func (p *GenProxy) fail(flow Flow, err error) {
+	flow.Error = classifyUpstreamError(err)
+	flow.Wait = time.Since(flow.StartedAt)
+	log.Warn().Err(err).Msgf("%s %s: %s", flow.Request.Method, flow.Request.URL.String(), flow.Error)
+	p.complete(flow)
+}
+
+// EnableCapture appends every completed flow to the capture file at path.
+func (p *GenProxy) EnableCapture(path string) error {
+	w, err := NewCaptureWriter(path)
+	if err != nil {
+		return err
+	}
+	p.capture = w
+	return nil
+}
+
+// レスポンスボディを読み切った時点で呼ばれる
+func (p *GenProxy) complete(flow Flow) {
+	if flow.Error == "" {
+		flow.Receive = time.Since(flow.StartedAt) - flow.Wait
+	}
+	// 圧縮されたままだと比較や正規化ができないので展開して記録する
+	var reqBody, respBody []byte
+	reqBody, flow.RequestUndecoded = decodeBody(flow.Request.Header, readAllBody(flow.Request.Body))
+	respBody, flow.ResponseUndecoded = decodeBody(flow.Response.Header, readAllBody(flow.Response.Body))
+	flow.Request.Body = io.NopCloser(bytes.NewReader(reqBody))
+	flow.Response.Body = io.NopCloser(bytes.NewReader(respBody))
+	p.flows.add(flow)
+	if p.capture == nil {
+		return
+	}
+	if err := p.capture.write(flow, reqBody, respBody); err != nil {
+		log.Error().Err(err).Msg("failed to write capture")
+	}
+}
+
+// ServeHTTP handles WebSocket upgrades by itself and passes other requests to goproxy.
+func (p *GenProxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.IsAbs() && isWebSocketRequest(r) {
+		p.serveWebSocket(rw, r)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.proxy.ServeHTTP(rw, r)
+		return
+	}
+	// goproxyはSSE以外はバッファしてしまうのでストリーミングのレスポンスも届くたびに返す
+	p.proxy.ServeHTTP(&flushWriter{ResponseWriter: rw}, r)
+}
+
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+	return n, err
 }
 
 func (p *GenProxy) Proxy() *goproxy.ProxyHttpServer {
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPI 3 (https://spec.openapis.org/oas/v3.0.3)
+// stubの生成に必要な項目のみ定義している
+type OpenAPI struct {
+	OpenAPI string                      `yaml:"openapi"`
+	Info    OpenAPIInfo                 `yaml:"info"`
+	Servers []OpenAPIServer             `yaml:"servers,omitempty"`
+	Paths   map[string]*OpenAPIPathItem `yaml:"paths"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `yaml:"title"`
+	Version string `yaml:"version"`
+}
+
+type OpenAPIServer struct {
+	URL       string                            `yaml:"url"`
+	Variables map[string]*OpenAPIServerVariable `yaml:"variables,omitempty"`
+}
+
+type OpenAPIServerVariable struct {
+	Default string `yaml:"default"`
+}
+
+type OpenAPIPathItem struct {
+	Get        *OpenAPIOperation  `yaml:"get,omitempty"`
+	Put        *OpenAPIOperation  `yaml:"put,omitempty"`
+	Post       *OpenAPIOperation  `yaml:"post,omitempty"`
+	Delete     *OpenAPIOperation  `yaml:"delete,omitempty"`
+	Options    *OpenAPIOperation  `yaml:"options,omitempty"`
+	Head       *OpenAPIOperation  `yaml:"head,omitempty"`
+	Patch      *OpenAPIOperation  `yaml:"patch,omitempty"`
+	Trace      *OpenAPIOperation  `yaml:"trace,omitempty"`
+	Parameters []OpenAPIParameter `yaml:"parameters,omitempty"`
+}
+
+type OpenAPIOperation struct {
+	Summary     string                      `yaml:"summary,omitempty"`
+	OperationID string                      `yaml:"operationId,omitempty"`
+	Parameters  []OpenAPIParameter          `yaml:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `yaml:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `yaml:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name     string                     `yaml:"name"`
+	In       string                     `yaml:"in"`
+	Required bool                       `yaml:"required,omitempty"`
+	Schema   *OpenAPISchema             `yaml:"schema,omitempty"`
+	Example  interface{}                `yaml:"example,omitempty"`
+	Examples map[string]*OpenAPIExample `yaml:"examples,omitempty"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                         `yaml:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `yaml:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                       `yaml:"description"`
+	Content     map[string]*OpenAPIMediaType `yaml:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema   *OpenAPISchema             `yaml:"schema,omitempty"`
+	Example  interface{}                `yaml:"example,omitempty"`
+	Examples map[string]*OpenAPIExample `yaml:"examples,omitempty"`
+}
+
+type OpenAPIExample struct {
+	Summary string      `yaml:"summary,omitempty"`
+	Value   interface{} `yaml:"value,omitempty"`
+}
+
+type OpenAPISchema struct {
+	Type       string                    `yaml:"type,omitempty"`
+	Format     string                    `yaml:"format,omitempty"`
+	Nullable   bool                      `yaml:"nullable,omitempty"`
+	Properties map[string]*OpenAPISchema `yaml:"properties,omitempty"`
+	Required   []string                  `yaml:"required,omitempty"`
+	Items      *OpenAPISchema            `yaml:"items,omitempty"`
+	Example    interface{}               `yaml:"example,omitempty"`
+	Default    interface{}               `yaml:"default,omitempty"`
+}
+
+func (p *OpenAPIPathItem) setOperation(method string, op *OpenAPIOperation) {
+	switch method {
+	case http.MethodGet:
+		p.Get = op
+	case http.MethodPut:
+		p.Put = op
+	case http.MethodPost:
+		p.Post = op
+	case http.MethodDelete:
+		p.Delete = op
+	case http.MethodOptions:
+		p.Options = op
+	case http.MethodHead:
+		p.Head = op
+	case http.MethodPatch:
+		p.Patch = op
+	case http.MethodTrace:
+		p.Trace = op
+	}
+}
+
+func (p *OpenAPIPathItem) operations() map[string]*OpenAPIOperation {
+	ops := map[string]*OpenAPIOperation{
+		http.MethodGet:     p.Get,
+		http.MethodPut:     p.Put,
+		http.MethodPost:    p.Post,
+		http.MethodDelete:  p.Delete,
+		http.MethodOptions: p.Options,
+		http.MethodHead:    p.Head,
+		http.MethodPatch:   p.Patch,
+		http.MethodTrace:   p.Trace,
+	}
+	for method, op := range ops {
+		if op == nil {
+			delete(ops, method)
+		}
+	}
+	return ops
+}
+
+// ReadOpenAPIFile creates flows from the paths and the response examples of an OpenAPI 3 document.
+// YAML and JSON are both accepted.
+func ReadOpenAPIFile(path string) (map[string]Flow, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read openapi file: %w", err)
+	}
+	var spec OpenAPI
+	if err := yaml.Unmarshal(b, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse openapi file %s: %w", path, err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		return nil, fmt.Errorf("%s: unsupported openapi version %q", path, spec.OpenAPI)
+	}
+	base, err := spec.baseURL()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	flows := make(map[string]Flow)
+	paths := make([]string, 0, len(spec.Paths))
+	for p := range spec.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		item := spec.Paths[p]
+		if item == nil {
+			continue
+		}
+		for method, op := range item.operations() {
+			params := append(append([]OpenAPIParameter{}, item.Parameters...), op.Parameters...)
+			u := *base
+			u.Path = strings.TrimSuffix(base.Path, "/") + expandPathParameters(p, params)
+			query := url.Values{}
+			header := http.Header{}
+			for _, param := range params {
+				v, ok := param.exampleValue()
+				if !ok {
+					continue
+				}
+				switch param.In {
+				case "query":
+					query.Add(param.Name, v)
+				case "header":
+					header.Add(param.Name, v)
+				}
+			}
+			u.RawQuery = query.Encode()
+
+			var reqBody []byte
+			if op.RequestBody != nil {
+				if mediaType, content := preferredMediaType(op.RequestBody.Content); content != nil {
+					if examples := content.exampleBodies(mediaType); len(examples) > 0 {
+						reqBody = examples[0]
+						header.Set("Content-Type", mediaType)
+					}
+				}
+			}
+
+			statusCode, resp, ok := stubResponse(op.Responses)
+			if !ok {
+				continue
+			}
+			mediaType, content := preferredMediaType(resp.Content)
+			var body []byte
+			if content != nil {
+				if bodies := content.exampleBodies(mediaType); len(bodies) > 0 {
+					body = bodies[0]
+				}
+			}
+			respHeader := http.Header{}
+			if mediaType != "" {
+				respHeader.Set("Content-Type", mediaType)
+			}
+			id := fmt.Sprintf("%s#%s %s %d", path, method, p, statusCode)
+			reqURL := u
+			flows[id] = Flow{
+				ID: id,
+				Request: http.Request{
+					Method: method,
+					URL:    &reqURL,
+					Host:   u.Host,
+					Header: header,
+					Body:   io.NopCloser(bytes.NewReader(reqBody)),
+				},
+				Response: http.Response{
+					StatusCode: statusCode,
+					Header:     respHeader,
+					Body:       io.NopCloser(bytes.NewReader(body)),
+				},
+			}
+		}
+	}
+	return flows, nil
+}
+
+// スタブが返すレスポンスとして最も小さい2xx、なければdefaultを選ぶ
+// 同じリクエストのフローが複数あると順番に再生されるので他のステータスコードは使わない
+func stubResponse(responses map[string]*OpenAPIResponse) (int, *OpenAPIResponse, bool) {
+	best := 0
+	for status, resp := range responses {
+		code, err := strconv.Atoi(status)
+		if err != nil || resp == nil || code < 200 || code > 299 {
+			continue
+		}
+		if best == 0 || code < best {
+			best = code
+		}
+	}
+	if best != 0 {
+		return best, responses[strconv.Itoa(best)], true
+	}
+	if resp, ok := responses["default"]; ok && resp != nil {
+		return http.StatusOK, resp, true
+	}
+	return 0, nil, false
+}
+
+func (spec *OpenAPI) baseURL() (*url.URL, error) {
+	if len(spec.Servers) == 0 {
+		return nil, fmt.Errorf("servers is required to decide the host of the stub")
+	}
+	server := spec.Servers[0]
+	raw := server.URL
+	for name, v := range server.Variables {
+		raw = strings.ReplaceAll(raw, "{"+name+"}", v.Default)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("server url %q must be absolute", server.URL)
+	}
+	return u, nil
+}
+
+// パスパラメータはexampleがあればその値で置き換える
+// なければ{name}のまま残し、任意の値にマッチするテンプレートのパスとしてルーティングする
+func expandPathParameters(path string, params []OpenAPIParameter) string {
+	for _, param := range params {
+		if param.In != "path" {
+			continue
+		}
+		if v, ok := param.exampleValue(); ok {
+			path = strings.ReplaceAll(path, "{"+param.Name+"}", url.PathEscape(v))
+		}
+	}
+	return path
+}
+
+func (p OpenAPIParameter) exampleValue() (string, bool) {
+	if p.Example != nil {
+		return fmt.Sprint(p.Example), true
+	}
+	for _, name := range sortedKeys(p.Examples) {
+		if p.Examples[name] != nil && p.Examples[name].Value != nil {
+			return fmt.Sprint(p.Examples[name].Value), true
+		}
+	}
+	if p.Schema != nil {
+		if p.Schema.Example != nil {
+			return fmt.Sprint(p.Schema.Example), true
+		}
+		if p.Schema.Default != nil {
+			return fmt.Sprint(p.Schema.Default), true
+		}
+	}
+	return "", false
+}
+
+// JSONのメディアタイプを優先する
+func preferredMediaType(content map[string]*OpenAPIMediaType) (string, *OpenAPIMediaType) {
+	mediaTypes := sortedKeys(content)
+	for _, mediaType := range mediaTypes {
+		if isJSONMediaType(mediaType) {
+			return mediaType, content[mediaType]
+		}
+	}
+	if len(mediaTypes) == 0 {
+		return "", nil
+	}
+	return mediaTypes[0], content[mediaTypes[0]]
+}
+
+func (m *OpenAPIMediaType) exampleBodies(mediaType string) [][]byte {
+	var values []interface{}
+	if m.Example != nil {
+		values = append(values, m.Example)
+	}
+	for _, name := range sortedKeys(m.Examples) {
+		if m.Examples[name] != nil && m.Examples[name].Value != nil {
+			values = append(values, m.Examples[name].Value)
+		}
+	}
+	if len(values) == 0 && m.Schema != nil && m.Schema.Example != nil {
+		values = append(values, m.Schema.Example)
+	}
+	var bodies [][]byte
+	for _, v := range values {
+		if s, ok := v.(string); ok && !isJSONMediaType(mediaType) {
+			bodies = append(bodies, []byte(s))
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		bodies = append(bodies, b)
+	}
+	return bodies
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return strings.Contains(mediaType, "json")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewOpenAPIDocuments infers an OpenAPI document per host from the tree built by createExternalAPITree.
+func NewOpenAPIDocuments(root SyntaxNode) []OpenAPI {
+	var docs []OpenAPI
+	hosts := root.children()
+	for _, hostKey := range sortedKeys(hosts) {
+		host := hosts[hostKey]
+		doc := OpenAPI{
+			OpenAPI: "3.0.3",
+			Info: OpenAPIInfo{
+				Title:   host.value(),
+				Version: "1.0.0",
+			},
+			Servers: []OpenAPIServer{{URL: host.value()}},
+			Paths:   make(map[string]*OpenAPIPathItem),
+		}
+		paths := host.children()
+		for _, pathKey := range sortedKeys(paths) {
+			item := &OpenAPIPathItem{}
+			methods := make(map[string][]SyntaxNode)
+			var values []string
+			for _, key := range sortedKeys(paths[pathKey].children()) {
+				child := paths[pathKey].children()[key]
+				if _, ok := child.(*PathValue); !ok {
+					methods[key] = append(methods[key], child)
+					continue
+				}
+				values = append(values, key)
+				for _, methodKey := range sortedKeys(child.children()) {
+					methods[methodKey] = append(methods[methodKey], child.children()[methodKey])
+				}
+			}
+			for _, methodKey := range sortedKeys(methods) {
+				op := newOpenAPIOperation(methods[methodKey]...)
+				op.Parameters = append(pathParameters(pathKey, values), op.Parameters...)
+				item.setOperation(methodKey, op)
+			}
+			doc.Paths[pathKey] = item
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// テンプレートのパラメータを記録された最初の値を例としてパスパラメータにする
+func pathParameters(template string, values []string) []OpenAPIParameter {
+	var params []OpenAPIParameter
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		param := OpenAPIParameter{
+			Name:     segment[1 : len(segment)-1],
+			In:       "path",
+			Required: true,
+			Schema:   &OpenAPISchema{Type: "string"},
+		}
+		if len(values) > 0 {
+			if recorded := strings.Split(values[0], "/"); i < len(recorded) {
+				param.Example = recorded[i]
+			}
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+// WriteOpenAPI writes documents as a multi-document YAML stream.
+func WriteOpenAPI(w io.Writer, docs []OpenAPI) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("failed to write openapi: %w", err)
+		}
+	}
+	return enc.Close()
+}
+
+// 観測したボディからスキーマを推論するための集計
+type bodySamples struct {
+	count int
+	// 最初のボディのContent-Typeのメディアタイプ
+	mediaType string
+	schema    *OpenAPISchema
+	example   interface{}
+	// JSONやフォームとして解釈できないボディが1つでもあればfalse
+	structured bool
+	binary     bool
+}
+
+func (b *bodySamples) add(body, contentType string) {
+	if body == "" {
+		return
+	}
+	if b.count == 0 {
+		b.structured = true
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			b.mediaType = mediaType
+		}
+	}
+	b.count++
+	v, err := decodeBodySample(body, contentType)
+	if err != nil {
+		b.structured = false
+		if !utf8.ValidString(body) {
+			b.binary = true
+		}
+		if b.example == nil {
+			b.example = body
+		}
+		return
+	}
+	if b.example == nil {
+		b.example = exampleValue(v)
+	}
+	b.schema = mergeSchema(b.schema, inferSchema(v))
+}
+
+func (b *bodySamples) content() map[string]*OpenAPIMediaType {
+	if b.count == 0 {
+		return nil
+	}
+	mediaType := func(fallback string) string {
+		if b.mediaType != "" {
+			return b.mediaType
+		}
+		return fallback
+	}
+	if b.structured {
+		return map[string]*OpenAPIMediaType{
+			mediaType("application/json"): {
+				Schema:  b.schema,
+				Example: b.example,
+			},
+		}
+	}
+	if b.binary {
+		return map[string]*OpenAPIMediaType{
+			mediaType("application/octet-stream"): {
+				Schema: &OpenAPISchema{Type: "string", Format: "binary"},
+			},
+		}
+	}
+	return map[string]*OpenAPIMediaType{
+		mediaType("text/plain"): {
+			Schema:  &OpenAPISchema{Type: "string"},
+			Example: b.example,
+		},
+	}
+}
+
+// テンプレートのパスでは記録された値のパスごとのメソッドをまとめて1つのオペレーションにする
+func newOpenAPIOperation(methods ...SyntaxNode) *OpenAPIOperation {
+	op := &OpenAPIOperation{
+		Responses: make(map[string]*OpenAPIResponse),
+	}
+	queryExamples := make(map[string]string)
+	queryCounts := make(map[string]int)
+	headerExamples := make(map[string]string)
+	headerCounts := make(map[string]int)
+	headerNodes := 0
+	var requests bodySamples
+	responses := make(map[int]*bodySamples)
+
+	var queries []SyntaxNode
+	for _, method := range methods {
+		for _, queryKey := range sortedKeys(method.children()) {
+			queries = append(queries, method.children()[queryKey])
+		}
+	}
+	for _, q := range queries {
+		queryKey := q.value()
+		var query url.Values
+		if err := json.Unmarshal([]byte(queryKey), &query); err == nil {
+			for k, vv := range query {
+				queryCounts[k]++
+				if _, found := queryExamples[k]; !found && len(vv) > 0 {
+					queryExamples[k] = vv[0]
+				}
+			}
+		}
+		var reqBodies []SyntaxNode
+		children := q.children()
+		for _, key := range sortedKeys(children) {
+			h, ok := children[key].(*RequestHeader)
+			if !ok {
+				reqBodies = append(reqBodies, children[key])
+				continue
+			}
+			// ヘッダでマッチングしている場合はヘッダの階層を挟む
+			headerNodes++
+			var header http.Header
+			if err := json.Unmarshal([]byte(h.value()), &header); err == nil {
+				for k, vv := range header {
+					headerCounts[k]++
+					if _, found := headerExamples[k]; !found && len(vv) > 0 {
+						headerExamples[k] = vv[0]
+					}
+				}
+			}
+			for _, reqKey := range sortedKeys(h.children()) {
+				reqBodies = append(reqBodies, h.children()[reqKey])
+			}
+		}
+		for _, req := range reqBodies {
+			if r, ok := req.(*ReqBody); ok {
+				// マッチング用に正規化したValueではなく記録されたままのボディから推論する
+				requests.add(r.Body, r.ContentType)
+			}
+			for _, resp := range req.children() {
+				r, ok := resp.(*RespBody)
+				if !ok || r.Error != "" {
+					continue
+				}
+				if _, found := responses[r.StatusCode]; !found {
+					responses[r.StatusCode] = &bodySamples{}
+				}
+				responses[r.StatusCode].add(r.Value, "")
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(queryCounts) {
+		op.Parameters = append(op.Parameters, OpenAPIParameter{
+			Name:     name,
+			In:       "query",
+			Required: queryCounts[name] == len(queries),
+			Schema:   &OpenAPISchema{Type: "string"},
+			Example:  queryExamples[name],
+		})
+	}
+	for _, name := range sortedKeys(headerCounts) {
+		op.Parameters = append(op.Parameters, OpenAPIParameter{
+			Name:     name,
+			In:       "header",
+			Required: headerCounts[name] == headerNodes,
+			Schema:   &OpenAPISchema{Type: "string"},
+			Example:  headerExamples[name],
+		})
+	}
+	if content := requests.content(); content != nil {
+		op.RequestBody = &OpenAPIRequestBody{
+			Required: requests.count == len(queries),
+			Content:  content,
+		}
+	}
+	for status, samples := range responses {
+		op.Responses[strconv.Itoa(status)] = &OpenAPIResponse{
+			Description: http.StatusText(status),
+			Content:     samples.content(),
+		}
+	}
+	return op
+}
+
+// Content-Typeに従ってボディを解釈する
+// Content-TypeがなければJSONとして解釈する
+func decodeBodySample(body, contentType string) (interface{}, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return decodeJSONSample(body)
+	}
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(body)
+		if err != nil {
+			return nil, err
+		}
+		form := make(map[string]interface{}, len(values))
+		for k, vv := range values {
+			form[k] = formSampleValue(vv)
+		}
+		return form, nil
+	case mediaType == "multipart/form-data":
+		values := make(map[string][]interface{})
+		mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			b, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			var value interface{} = string(b)
+			if part.FileName() != "" {
+				value = fileSample(part.FileName())
+			}
+			values[part.FormName()] = append(values[part.FormName()], value)
+		}
+		form := make(map[string]interface{}, len(values))
+		for k, vv := range values {
+			form[k] = formSampleValue(vv)
+		}
+		return form, nil
+	case isJSONMediaType(mediaType):
+		return decodeJSONSample(body)
+	}
+	return nil, fmt.Errorf("unstructured media type: %s", mediaType)
+}
+
+// multipartでアップロードされたファイル
+// スキーマはバイナリの文字列にし、例にはファイル名を使う
+type fileSample string
+
+// 同じ名前のフィールドが複数ある場合のみ配列にする
+func formSampleValue[V any](vv []V) interface{} {
+	if len(vv) == 1 {
+		return vv[0]
+	}
+	values := make([]interface{}, 0, len(vv))
+	for _, v := range vv {
+		values = append(values, v)
+	}
+	return values
+}
+
+func decodeJSONSample(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after json value")
+	}
+	return v, nil
+}
+
+func inferSchema(v interface{}) *OpenAPISchema {
+	switch t := v.(type) {
+	case nil:
+		return &OpenAPISchema{Nullable: true}
+	case bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return &OpenAPISchema{Type: "integer"}
+		}
+		return &OpenAPISchema{Type: "number"}
+	case string:
+		return &OpenAPISchema{Type: "string"}
+	case fileSample:
+		return &OpenAPISchema{Type: "string", Format: "binary"}
+	case []interface{}:
+		var items *OpenAPISchema
+		for _, e := range t {
+			items = mergeSchema(items, inferSchema(e))
+		}
+		if items == nil {
+			items = &OpenAPISchema{}
+		}
+		return &OpenAPISchema{Type: "array", Items: items}
+	case map[string]interface{}:
+		schema := &OpenAPISchema{
+			Type:       "object",
+			Properties: make(map[string]*OpenAPISchema),
+		}
+		for _, k := range sortedKeys(t) {
+			schema.Properties[k] = inferSchema(t[k])
+			schema.Required = append(schema.Required, k)
+		}
+		return schema
+	}
+	return &OpenAPISchema{}
+}
+
+// 複数のサンプルから推論したスキーマをまとめる
+// requiredは全てのサンプルに存在するプロパティのみにする
+func mergeSchema(a, b *OpenAPISchema) *OpenAPISchema {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := &OpenAPISchema{
+		Type:     a.Type,
+		Nullable: a.Nullable || b.Nullable,
+	}
+	if a.Format == b.Format {
+		merged.Format = a.Format
+	}
+	switch {
+	case a.Type == b.Type:
+	case a.Type == "":
+		merged.Type = b.Type
+		if !a.Nullable {
+			merged.Type = ""
+		}
+	case b.Type == "":
+		if !b.Nullable {
+			merged.Type = ""
+		}
+	case (a.Type == "integer" && b.Type == "number") || (a.Type == "number" && b.Type == "integer"):
+		merged.Type = "number"
+	default:
+		// 型が一致しない場合は型を指定しない
+		merged.Type = ""
+	}
+	switch merged.Type {
+	case "array":
+		merged.Items = mergeSchema(a.Items, b.Items)
+	case "object":
+		merged.Properties = make(map[string]*OpenAPISchema)
+		for k, v := range a.Properties {
+			merged.Properties[k] = mergeSchema(v, b.Properties[k])
+		}
+		for k, v := range b.Properties {
+			if _, found := merged.Properties[k]; !found {
+				merged.Properties[k] = v
+			}
+		}
+		required := make(map[string]bool)
+		for _, k := range a.Required {
+			required[k] = true
+		}
+		for _, k := range b.Required {
+			if required[k] {
+				merged.Required = append(merged.Required, k)
+			}
+		}
+	}
+	return merged
+}
+
+// json.NumberのままだとYAMLで文字列として出力されるので数値に戻す
+func exampleValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	case fileSample:
+		return string(t)
+	case []interface{}:
+		values := make([]interface{}, 0, len(t))
+		for _, e := range t {
+			values = append(values, exampleValue(e))
+		}
+		return values
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			values[k] = exampleValue(e)
+		}
+		return values
+	}
+	return v
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testOpenAPI = `
+openapi: 3.0.3
+info:
+  title: users
+  version: 1.0.0
+servers:
+  - url: https://{env}.example.com/v1
+    variables:
+      env:
+        default: api
+paths:
+  /users/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: integer
+          example: 123
+    get:
+      parameters:
+        - name: lang
+          in: query
+          example: ja
+      responses:
+        "200":
+          description: ok
+          content:
+            application/json:
+              example:
+                id: 123
+                name: foo
+        "404":
+          description: not found
+        default:
+          description: error
+  /users:
+    post:
+      requestBody:
+        content:
+          application/json:
+            example:
+              name: bar
+      responses:
+        "201":
+          description: created
+          content:
+            application/json:
+              examples:
+                first:
+                  value:
+                    id: 1
+                second:
+                  value:
+                    id: 2
+    delete:
+      responses:
+        "404":
+          description: not found
+        default:
+          description: deleted
+          content:
+            application/json:
+              example:
+                deleted: true
+`
+
+func TestReadOpenAPIFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spec.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(testOpenAPI), 0644))
+	flows, err := ReadOpenAPIFile(path)
+	assert.NoError(t, err)
+	// 操作ごとに1つのフローにして同じリクエストに別のステータスコードを再生しない
+	assert.Equal(t, 3, len(flows))
+
+	get := flows[path+"#GET /users/{id} 200"]
+	assert.Equal(t, "https://api.example.com/v1/users/123?lang=ja", get.Request.URL.String())
+	assert.Equal(t, "api.example.com", get.Request.Host)
+	body, _ := io.ReadAll(get.Response.Body)
+	assert.JSONEq(t, `{"id":123,"name":"foo"}`, string(body))
+
+	post := flows[path+"#POST /users 201"]
+	reqBody, _ := io.ReadAll(post.Request.Body)
+	assert.JSONEq(t, `{"name":"bar"}`, string(reqBody))
+	body, _ = io.ReadAll(post.Response.Body)
+	assert.JSONEq(t, `{"id":1}`, string(body))
+
+	// 2xxがなければdefaultを返す
+	deleted := flows[path+"#DELETE /users 200"]
+	assert.Equal(t, 200, deleted.Response.StatusCode)
+	body, _ = io.ReadAll(deleted.Response.Body)
+	assert.JSONEq(t, `{"deleted":true}`, string(body))
+}
+
+func TestNewOpenAPIDocuments(t *testing.T) {
+	newNode := func(value string) Node {
+		return Node{Value: value, Children: make(map[string]SyntaxNode)}
+	}
+	r := Root(newNode(""))
+	host := Host(newNode("http://example.com:80"))
+	path := Path(newNode("/users"))
+	method := Method(newNode("GET"))
+	q1 := QueryParameter(newNode(`{"page":["1"]}`))
+	q2 := QueryParameter(newNode(`{"page":["2"],"sort":["name"]}`))
+	req1 := ReqBody{Children: make(map[string]SyntaxNode)}
+	req2 := ReqBody{Children: make(map[string]SyntaxNode)}
+	req1.addChild(&RespBody{StatusCode: 200, Value: `[{"id":1,"name":"foo","age":20}]`})
+	req2.addChild(&RespBody{StatusCode: 200, Value: `[{"id":18446744073709551615,"name":null}]`})
+	req2.addChild(&RespBody{StatusCode: 500, Value: `internal error`})
+	q1.addChild(&req1)
+	q2.addChild(&req2)
+	method.addChild(&q1)
+	method.addChild(&q2)
+	path.addChild(&method)
+	host.addChild(&path)
+	r.addChild(&host)
+
+	docs := NewOpenAPIDocuments(&r)
+	assert.Equal(t, 1, len(docs))
+	assert.Equal(t, "http://example.com:80", docs[0].Servers[0].URL)
+	op := docs[0].Paths["/users"].Get
+	assert.Equal(t, []OpenAPIParameter{
+		{Name: "page", In: "query", Required: true, Schema: &OpenAPISchema{Type: "string"}, Example: "1"},
+		{Name: "sort", In: "query", Required: false, Schema: &OpenAPISchema{Type: "string"}, Example: "name"},
+	}, op.Parameters)
+	assert.Nil(t, op.RequestBody)
+
+	items := op.Responses["200"].Content["application/json"].Schema.Items
+	assert.Equal(t, "object", items.Type)
+	assert.Equal(t, []string{"id", "name"}, items.Required)
+	assert.Equal(t, "number", items.Properties["id"].Type)
+	assert.Equal(t, &OpenAPISchema{Type: "string", Nullable: true}, items.Properties["name"])
+	assert.Equal(t, "integer", items.Properties["age"].Type)
+
+	assert.Equal(t, "internal error", op.Responses["500"].Content["text/plain"].Example)
+}
+
+func TestNewOpenAPIDocumentsRequestBody(t *testing.T) {
+	resetGenerator()
+	ignoreJSONPaths = [][]string{{"nonce"}}
+	defer func() {
+		ignoreJSONPaths = nil
+	}()
+	multipart := "--aaa\r\n" +
+		"Content-Disposition: form-data; name=\"name\"\r\n\r\nfoo\r\n" +
+		"--aaa\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"a.png\"\r\n\r\ncontent\r\n" +
+		"--aaa--\r\n"
+	requests := []struct {
+		path        string
+		contentType string
+		body        string
+	}{
+		{"/login", "application/x-www-form-urlencoded", "user=foo&tag=a&tag=b"},
+		{"/upload", "multipart/form-data; boundary=aaa", multipart},
+		{"/order", "application/json", `{"item":1,"nonce":"abc"}`},
+		{"/soap", "text/xml; charset=utf-8", `<Envelope><Body><Get/></Body></Envelope>`},
+	}
+	flows := map[string]Flow{}
+	for i, r := range requests {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "POST",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: r.path},
+				Header: http.Header{"Content-Type": []string{r.contentType}},
+				Body:   io.NopCloser(bytes.NewReader([]byte(r.body))),
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	docs := NewOpenAPIDocuments(o)
+	assert.Equal(t, 1, len(docs))
+
+	// 正規化したJSONではなくフォームとして記述する
+	login := docs[0].Paths["/login"].Post.RequestBody.Content
+	assert.Equal(t, 1, len(login))
+	form := login["application/x-www-form-urlencoded"]
+	assert.Equal(t, "object", form.Schema.Type)
+	assert.Equal(t, []string{"tag", "user"}, form.Schema.Required)
+	assert.Equal(t, &OpenAPISchema{Type: "string"}, form.Schema.Properties["user"])
+	assert.Equal(t, "array", form.Schema.Properties["tag"].Type)
+	assert.Equal(t, map[string]interface{}{"user": "foo", "tag": []interface{}{"a", "b"}}, form.Example)
+
+	upload := docs[0].Paths["/upload"].Post.RequestBody.Content["multipart/form-data"]
+	assert.Equal(t, &OpenAPISchema{Type: "string"}, upload.Schema.Properties["name"])
+	assert.Equal(t, &OpenAPISchema{Type: "string", Format: "binary"}, upload.Schema.Properties["file"])
+
+	// 比較から除くフィールドも記録されたボディにあれば記述する
+	order := docs[0].Paths["/order"].Post.RequestBody.Content["application/json"]
+	assert.Equal(t, []string{"item", "nonce"}, order.Schema.Required)
+	assert.Equal(t, map[string]interface{}{"item": int64(1), "nonce": "abc"}, order.Example)
+
+	// 正規化した文字列ではなく記録されたXMLを例にする
+	soap := docs[0].Paths["/soap"].Post.RequestBody.Content
+	assert.Equal(t, 1, len(soap))
+	assert.Equal(t, &OpenAPISchema{Type: "string"}, soap["text/xml"].Schema)
+	assert.Equal(t, `<Envelope><Body><Get/></Body></Envelope>`, soap["text/xml"].Example)
+}
+
+func TestStubOpenAPIPathParameterWithoutExample(t *testing.T) {
+	resetGenerator()
+	defer resetGenerator()
+	spec := `
+openapi: 3.0.3
+info:
+  title: items
+  version: 1.0.0
+servers:
+  - url: http://localhost:8080
+paths:
+  /items/{itemId}:
+    get:
+      parameters:
+        - name: itemId
+          in: path
+          required: true
+          schema:
+            type: string
+      responses:
+        "200":
+          description: ok
+          content:
+            application/json:
+              example:
+                name: foo
+`
+	path := filepath.Join(t.TempDir(), "spec.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(spec), 0644))
+	flows, err := ReadOpenAPIFile(path)
+	assert.NoError(t, err)
+	// exampleがなければテンプレートのまま任意の値にマッチさせる
+	base := runStub(t, flows)
+	for _, id := range []string{"1", "abc"} {
+		status, body := stubGet(t, base+"/items/"+id)
+		assert.Equal(t, 200, status, id)
+		assert.JSONEq(t, `{"name":"foo"}`, body)
+	}
+}
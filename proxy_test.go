@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -127,3 +135,154 @@ func createFlows() []FlowTest {
 	}
 	return flows
 }
+
+func TestProxyCapture(t *testing.T) {
+	testFlows := createFlows()
+	es := NewEndServer(testFlows)
+	p := NewGenProxy()
+	capturePath := filepath.Join(t.TempDir(), "capture.jsonl")
+	assert.NoError(t, p.EnableCapture(capturePath))
+	pserver := httptest.NewServer(p.Proxy())
+	url, _ := url.Parse(pserver.URL)
+	c := http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(url),
+		},
+	}
+	for _, flow := range testFlows {
+		resp, err := es.request(&c, &flow.Request)
+		assert.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	pserver.Close()
+	assert.NoError(t, p.capture.Close())
+
+	f, err := os.Open(capturePath)
+	assert.NoError(t, err)
+	defer f.Close()
+	var records []CapturedFlow
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record CapturedFlow
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	assert.Equal(t, len(testFlows), len(records))
+	for _, record := range records {
+		assert.Equal(t, captureVersion, record.Version)
+		assert.Equal(t, 200, record.Response.StatusCode)
+		assert.NotEmpty(t, record.Response.Body)
+	}
+}
+
+func TestProxyUpstreamFailure(t *testing.T) {
+	// 閉じたポートに接続させてconnection refusedを発生させる
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	p := NewGenProxy()
+	pserver := httptest.NewServer(p.Proxy())
+	defer pserver.Close()
+	url, _ := url.Parse(pserver.URL)
+	c := http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(url),
+		},
+	}
+	resp, err := c.Get("http://" + addr + "/down")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 500, resp.StatusCode)
+
+	capturedFlows := p.Flows()
+	assert.Equal(t, 1, len(capturedFlows))
+	for _, flow := range capturedFlows {
+		assert.Equal(t, upstreamErrorRefused, flow.Error)
+		assert.Equal(t, "/down", flow.Request.URL.Path)
+	}
+}
+
+func TestProxyHTTP2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	p := NewGenProxy()
+	c := http.Client{
+		Transport: &http.Transport{
+			// CONNECTを受け付けた後のコネクションを直接渡す
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				client, server := net.Pipe()
+				go serveMitm(p, addr, server, &tls.Config{
+					Certificates: upstream.TLS.Certificates,
+					NextProtos:   []string{"h2", "http/1.1"},
+				})
+				established := make([]byte, len("HTTP/1.0 200 OK\r\n\r\n"))
+				if _, err := io.ReadFull(client, established); err != nil {
+					return nil, err
+				}
+				conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+				return conn, conn.HandshakeContext(ctx)
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := c.Get(upstream.URL + "/h2")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "HTTP/2.0", string(body))
+
+	capturedFlows := p.Flows()
+	assert.Equal(t, 1, len(capturedFlows))
+	for _, flow := range capturedFlows {
+		assert.Equal(t, "HTTP/2.0", flow.Request.Proto)
+		assert.Equal(t, "HTTP/2.0", flow.Response.Proto)
+		assert.Equal(t, "https", flow.Request.URL.Scheme)
+	}
+}
+
+func TestProxyStreaming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{"data: 1\n\n", "data: 2\n\n"} {
+			fmt.Fprint(rw, event)
+			rw.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	p := NewGenProxy()
+	pserver := httptest.NewServer(p.Proxy())
+	defer pserver.Close()
+	url, _ := url.Parse(pserver.URL)
+	c := http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(url),
+		},
+	}
+	resp, err := c.Get(upstream.URL + "/events")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", string(body))
+
+	capturedFlows := p.Flows()
+	assert.Equal(t, 1, len(capturedFlows))
+	for _, flow := range capturedFlows {
+		assert.Equal(t, 2, len(flow.Chunks))
+		assert.Equal(t, 9, flow.Chunks[0].Size)
+		assert.GreaterOrEqual(t, flow.Chunks[1].At-flow.Chunks[0].At, 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upstreams maps listening ports and Host headers to the upstream URL of the reverse proxy.
+type Upstreams struct {
+	Ports map[int]*url.URL
+	Hosts map[string]*url.URL
+}
+
+// ParseUpstreams parses values in the form of "<port or host>=<upstream url>".
+func ParseUpstreams(values []string) (Upstreams, error) {
+	upstreams := Upstreams{
+		Ports: make(map[int]*url.URL),
+		Hosts: make(map[string]*url.URL),
+	}
+	for _, v := range values {
+		listen, rawURL, found := strings.Cut(v, "=")
+		if !found || listen == "" {
+			return Upstreams{}, fmt.Errorf("invalid upstream %q: must be <port or host>=<upstream url>", v)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return Upstreams{}, fmt.Errorf("invalid upstream url %q", rawURL)
+		}
+		if port, err := strconv.Atoi(listen); err == nil {
+			upstreams.Ports[port] = u
+		} else {
+			upstreams.Hosts[strings.ToLower(listen)] = u
+		}
+	}
+	return upstreams, nil
+}
+
+// ReverseProxy returns a handler which forwards every request to upstream and records the flows.
+func (p *GenProxy) ReverseProxy(upstream *url.URL) http.Handler {
+	rp := httputil.NewSingleHostReverseProxy(upstream)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		// 外部APIとして記録されるようにHostも転送先に書き換える
+		r.Host = upstream.Host
+	}
+	rp.Transport = &recordingTransport{
+		proxy: p,
+		base:  p.proxy.Tr,
+	}
+	return rp
+}
+
+// RouteByHost forwards requests to the upstream of the Host header as a reverse proxy.
+// Requests for other hosts and proxy requests(absolute URL or CONNECT) are passed to next.
+func (p *GenProxy) RouteByHost(hosts map[string]*url.URL, next http.Handler) http.Handler {
+	handlers := make(map[string]http.Handler)
+	for host, upstream := range hosts {
+		handlers[host] = p.ReverseProxy(upstream)
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+			host := strings.ToLower(r.Host)
+			if h, ok := handlers[host]; ok {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				if h, ok := handlers[hostname]; ok {
+					h.ServeHTTP(rw, r)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// フォワードプロキシと同じようにフローを記録するTransport
+type recordingTransport struct {
+	proxy *GenProxy
+	base  http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if isWebSocketRequest(r) {
+		// 圧縮されるとフレームの中身を記録できないので拡張はネゴシエートさせない
+		r.Header.Del("Sec-WebSocket-Extensions")
+	}
+	flow := t.proxy.begin(r)
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		t.proxy.fail(flow, err)
+		return nil, err
+	}
+	flow.Wait = time.Since(flow.StartedAt)
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		flow.Response = http.Response{
+			StatusCode: resp.StatusCode,
+			Proto:      resp.Proto,
+			Header:     resp.Header,
+		}
+		resp.Body = t.proxy.recordWebSocket(flow, conn)
+		return resp, nil
+	}
+	t.proxy.receive(flow, resp)
+	return resp, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := ParseUpstreams([]string{"8081=https://api.example.com", "Payment.local=http://localhost:9000/v1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.example.com", upstreams.Ports[8081].String())
+	assert.Equal(t, "http://localhost:9000/v1", upstreams.Hosts["payment.local"].String())
+
+	_, err = ParseUpstreams([]string{"8081"})
+	assert.Error(t, err)
+	_, err = ParseUpstreams([]string{"8081=api.example.com"})
+	assert.Error(t, err)
+}
+
+func TestReverseProxy(t *testing.T) {
+	testFlows := createFlows()
+	es := NewEndServer(testFlows)
+	upstream, _ := url.Parse(es.server.URL)
+	p := NewGenProxy()
+	rserver := httptest.NewServer(p.ReverseProxy(upstream))
+	defer rserver.Close()
+	for _, flow := range testFlows {
+		req, err := http.NewRequest(flow.Request.Method, rserver.URL+flow.Request.URL.Path, nil)
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		actual, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		expected, err := io.ReadAll(flow.RespBody)
+		assert.NoError(t, err)
+		assert.Equal(t, string(expected), string(actual))
+	}
+	capturedFlows := p.Flows()
+	assert.Equal(t, len(testFlows), len(capturedFlows))
+	for _, flow := range capturedFlows {
+		// 転送先へのリクエストとして記録される
+		assert.Equal(t, upstream.Host, flow.Request.Host)
+		assert.Equal(t, upstream.Host, flow.Request.URL.Host)
+		assert.Equal(t, 200, flow.Response.StatusCode)
+	}
+}
+
+func TestRouteByHost(t *testing.T) {
+	testFlows := createFlows()
+	es := NewEndServer(testFlows)
+	upstream, _ := url.Parse(es.server.URL)
+	p := NewGenProxy()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	server := httptest.NewServer(p.RouteByHost(map[string]*url.URL{"api.local": upstream}, next))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Host = "api.local:8080"
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	req.Host = "other.local"
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+	assert.Equal(t, 1, len(p.Flows()))
+}
+
+func TestReverseProxyContentEncoding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(rw)
+		io.Copy(gw, gr)
+		gw.Close()
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	p := NewGenProxy()
+	rserver := httptest.NewServer(p.ReverseProxy(u))
+	defer rserver.Close()
+
+	var reqBody bytes.Buffer
+	gw := gzip.NewWriter(&reqBody)
+	io.WriteString(gw, `{"foo":"bar"}`)
+	gw.Close()
+	req, err := http.NewRequest("POST", rserver.URL+"/echo", &reqBody)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, `{"foo":"bar"}`, string(body))
+
+	// ボディを読み終えてフローが完了するのを待つ
+	assert.Eventually(t, func() bool {
+		for _, flow := range p.Flows() {
+			return flow.Receive > 0
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	for _, flow := range p.Flows() {
+		// 展開して記録し、ヘッダはそのまま残す
+		assert.Equal(t, `{"foo":"bar"}`, string(readAllBody(flow.Request.Body)))
+		assert.Equal(t, `{"foo":"bar"}`, string(readAllBody(flow.Response.Body)))
+		assert.Equal(t, "gzip", flow.Response.Header.Get("Content-Encoding"))
+	}
+}
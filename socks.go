@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SOCKS5 (RFC 1928)
+const (
+	socksVersion        = 0x05
+	socksMethodNoAuth   = 0x00
+	socksMethodNoAccept = 0xff
+	socksCmdConnect     = 0x01
+	socksAtypIPv4       = 0x01
+	socksAtypDomain     = 0x03
+	socksAtypIPv6       = 0x04
+
+	socksReplySucceeded        = 0x00
+	socksReplyGeneralFailure   = 0x01
+	socksReplyCmdNotSupported  = 0x07
+	socksReplyAtypNotSupported = 0x08
+)
+
+// TLSのClientHelloの先頭バイト
+const tlsRecordTypeHandshake byte = 0x16
+
+// ServeSocks accepts SOCKS5 connections on l and hands HTTP(S) traffic in them to the proxy,
+// so that flows are recorded in the same way as the HTTP proxy.
+func (p *GenProxy) ServeSocks(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept socks connection: %w", err)
+		}
+		go func() {
+			if err := p.handleSocks(conn); err != nil {
+				log.Warn().Err(err).Msgf("socks connection from %s", conn.RemoteAddr())
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (p *GenProxy) handleSocks(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	target, err := socksHandshake(r, conn)
+	if err != nil {
+		return err
+	}
+	// 接続先への接続はgoproxyが行うので先に成功を返す
+	if _, err := conn.Write([]byte{socksVersion, socksReplySucceeded, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	first, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	client := &peekedConn{Conn: conn, r: r}
+	if first[0] == tlsRecordTypeHandshake {
+		// TLSはHTTPプロキシのCONNECTと同じ経路(enableHttpsProxyのMITM)で処理する
+		req := &http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: target},
+			Host:       target,
+			Header:     http.Header{},
+			RemoteAddr: conn.RemoteAddr().String(),
+		}
+		p.proxy.ServeHTTP(&hijackResponseWriter{conn: &connectConn{peekedConn: client}}, req)
+		return nil
+	}
+	// 平文のHTTPはプロキシ宛ての絶対URLのリクエストとして処理する
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !r.URL.IsAbs() {
+				r.URL.Scheme = "http"
+				r.URL.Host = target
+			}
+			p.ServeHTTP(rw, r)
+		}),
+	}
+	if err := server.Serve(newSingleConnListener(client)); !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// クライアントの挨拶と接続要求を読み、接続先のhost:portを返す
+func socksHandshake(r *bufio.Reader, w io.Writer) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	if !bytes.Contains(methods, []byte{socksMethodNoAuth}) {
+		w.Write([]byte{socksVersion, socksMethodNoAccept})
+		return "", errors.New("no acceptable socks authentication method")
+	}
+	if _, err := w.Write([]byte{socksVersion, socksMethodNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(w, socksReplyCmdNotSupported)
+		return "", fmt.Errorf("unsupported socks command: %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if request[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(w, socksReplyAtypNotSupported)
+		return "", fmt.Errorf("unsupported socks address type: %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		socksReply(w, socksReplyGeneralFailure)
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socksReply(w io.Writer, reply byte) {
+	w.Write([]byte{socksVersion, reply, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+// Peekで先読みした分も含めて読み出すコネクション
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// goproxyがCONNECTに対して返すレスポンスはSOCKSでは不要なので捨てる
+type connectConn struct {
+	*peekedConn
+	established bool
+}
+
+func (c *connectConn) Write(b []byte) (int, error) {
+	if !c.established {
+		c.established = true
+		if bytes.HasPrefix(b, []byte("HTTP/")) {
+			return len(b), nil
+		}
+	}
+	return c.peekedConn.Write(b)
+}
+
+// goproxyのCONNECTの処理にコネクションを渡すためのResponseWriter
+type hijackResponseWriter struct {
+	conn   net.Conn
+	header http.Header
+}
+
+func (w *hijackResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *hijackResponseWriter) Write(b []byte) (int, error) {
+	return w.conn.Write(b)
+}
+
+func (w *hijackResponseWriter) WriteHeader(statusCode int) {}
+
+func (w *hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// 1つのコネクションだけを返し、そのコネクションが閉じられるまでAcceptをブロックするListener
+type singleConnListener struct {
+	conn      net.Conn
+	accepted  sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		closed: make(chan struct{}),
+	}
+	l.conn = &closeNotifyConn{Conn: conn, onClose: l.close}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.accepted.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
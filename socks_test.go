@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+)
+
+func newSocksClient(t *testing.T, p *GenProxy) *http.Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go p.ServeSocks(l)
+	dialer, err := proxy.SOCKS5("tcp", l.Addr().String(), nil, proxy.Direct)
+	assert.NoError(t, err)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func TestSocksProxy(t *testing.T) {
+	testFlows := createFlows()
+	es := NewEndServer(testFlows)
+	p := NewGenProxy()
+	c := newSocksClient(t, p)
+	for _, flow := range testFlows {
+		resp, err := es.request(c, &flow.Request)
+		assert.NoError(t, err)
+		actual, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		expected, err := io.ReadAll(flow.RespBody)
+		assert.NoError(t, err)
+		assert.Equal(t, string(expected), string(actual))
+	}
+	capturedFlows := p.Flows()
+	assert.Equal(t, len(testFlows), len(capturedFlows))
+	for _, flow := range capturedFlows {
+		assert.Equal(t, "http", flow.Request.URL.Scheme)
+		assert.Equal(t, es.server.Listener.Addr().String(), flow.Request.URL.Host)
+	}
+}
+
+func TestSocksProxyTLSTunnel(t *testing.T) {
+	// 証明書を指定していなければHTTPプロキシと同様にそのまま中継する
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer server.Close()
+	p := NewGenProxy()
+	c := newSocksClient(t, p)
+	resp, err := c.Get(server.URL)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, 0, len(p.Flows()))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 生成したスタブをビルドして起動し、ベースURLを返す
+// 標準パッケージだけを使うスタブを対象にする
+func runStub(t *testing.T, flows map[string]Flow, args ...string) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command is required to build the stub")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	mockServerPort = port
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module stub\n\ngo 1.18\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte(code), 0644))
+	build := exec.Command(goCmd, "build", "-o", "stub", ".")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+	out, err := build.CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		t.FailNow()
+	}
+
+	stub := exec.Command(filepath.Join(dir, "stub"), args...)
+	stub.Dir = dir
+	assert.NoError(t, stub.Start())
+	t.Cleanup(func() {
+		stub.Process.Kill()
+		stub.Wait()
+	})
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	assert.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+	return "http://" + addr
+}
+
+// スタブにリクエストを送ってステータスコードとボディを返す
+func stubGet(t *testing.T, url string) (int, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if !assert.NoError(t, err) {
+		return 0, ""
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return res.StatusCode, string(body)
+}
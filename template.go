@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IDとみなすパスのセグメント
+var defaultPathParamPatterns = []*regexp.Regexp{
+	// 数値
+	regexp.MustCompile(`^[0-9]+$`),
+	// UUID
+	regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+	// ハッシュ(MD5, SHA-1, SHA-256など)
+	regexp.MustCompile(`^[0-9a-fA-F]{16,}$`),
+}
+
+// ParsePathParamPatterns compiles user-supplied patterns of variable path segments.
+// A pattern must match a whole segment.
+func ParsePathParamPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid path parameter pattern %q: %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// 可変なセグメントを{id}, {id2}...に置き換えたテンプレートにする
+func templatePath(path string) string {
+	if !pathTemplates {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	params := 0
+	for i, segment := range segments {
+		if !isPathParam(segment) {
+			continue
+		}
+		params++
+		if params == 1 {
+			segments[i] = "{id}"
+		} else {
+			segments[i] = fmt.Sprintf("{id%d}", params)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// OpenAPIでexampleのないパスパラメータのように{name}のセグメントを含むか
+func isTemplatePath(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			return true
+		}
+	}
+	return false
+}
+
+func isPathParam(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	for _, re := range append(defaultPathParamPatterns, pathParamPatterns...) {
+		if re.MatchString(segment) {
+			return true
+		}
+	}
+	return false
+}
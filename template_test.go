@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplatePath(t *testing.T) {
+	pathTemplates = true
+	patterns, err := ParsePathParamPatterns([]string{`v[0-9]+`})
+	assert.NoError(t, err)
+	pathParamPatterns = patterns
+	defer func() {
+		pathTemplates = false
+		pathParamPatterns = nil
+	}()
+
+	assert.Equal(t, "/users/{id}", templatePath("/users/123"))
+	assert.Equal(t, "/users/{id}/orders/{id2}", templatePath("/users/123/orders/0b5e8f3c-6f6e-4c1f-9d0a-3b1b2f5e7a10"))
+	assert.Equal(t, "/blobs/{id}", templatePath("/blobs/da39a3ee5e6b4b0d3255bfef95601890afd80709"))
+	assert.Equal(t, "/api/{id}/users/me", templatePath("/api/v2/users/me"))
+	assert.Equal(t, "/users/", templatePath("/users/"))
+
+	_, err = ParsePathParamPatterns([]string{`[`})
+	assert.Error(t, err)
+
+	pathTemplates = false
+	assert.Equal(t, "/users/123", templatePath("/users/123"))
+}
+
+func TestGenerateTemplateRoute(t *testing.T) {
+	resetGenerator()
+	pathTemplates = true
+	defer func() { pathTemplates = false }()
+	flows := map[string]Flow{}
+	for i, path := range []string{"/users/123", "/users/456", "/users/me"} {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: path},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte(path))),
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `router := &templateRouter{mux: mux}`)
+	assert.Contains(t, code, `mux.HandleFunc("/users/me", func(rw http.ResponseWriter, r *http.Request) {`)
+	assert.Contains(t, code, `router.HandleFunc("/users/{id}", func(rw http.ResponseWriter, r *http.Request) {`)
+	// 記録されていない値はフォールバックする
+	assert.Contains(t, code, `if r.URL.Path == "/users/456" {`)
+	assert.NotContains(t, code, `recordedPath`)
+	assert.Contains(t, code, `Handler: enableLogRequest(router, port),`)
+
+	docs := NewOpenAPIDocuments(o)
+	op := docs[0].Paths["/users/{id}"].Get
+	assert.Equal(t, []OpenAPIParameter{
+		{Name: "id", In: "path", Required: true, Schema: &OpenAPISchema{Type: "string"}, Example: "123"},
+	}, op.Parameters)
+}
+
+func TestGenerateTemplateRouteAnyPathValue(t *testing.T) {
+	resetGenerator()
+	pathTemplates = true
+	anyPathValue = true
+	defer func() {
+		pathTemplates = false
+		anyPathValue = false
+	}()
+	flows := map[string]Flow{}
+	for i, path := range []string{"/users/456", "/users/123"} {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: path},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+			},
+		}
+	}
+	o, err := createExternalAPITree(flows)
+	assert.NoError(t, err)
+	code := renderFile(t, o)
+	assert.Contains(t, code, `path := recordedPath(r.URL.Path, "/users/123", "/users/456")`)
+	assert.Contains(t, code, `if path == "/users/456" {`)
+	assert.Contains(t, code, `func recordedPath(path string, recorded ...string) string {`)
+}
+
+func TestStubTemplateRoute(t *testing.T) {
+	resetGenerator()
+	pathTemplates = true
+	fallbackMode = "404"
+	defer func() {
+		pathTemplates = false
+		fallbackMode = "none"
+		resetGenerator()
+	}()
+	flows := map[string]Flow{}
+	for i, path := range []string{"/users/123", "/users/456", "/users/me"} {
+		id := strconv.Itoa(i)
+		flows[id] = Flow{
+			ID:        id,
+			StartedAt: time.Unix(int64(i), 0),
+			Request: http.Request{
+				Method: "GET",
+				Host:   "localhost:8080",
+				URL:    &url.URL{Scheme: "http", Path: path},
+			},
+			Response: http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(bytes.NewReader([]byte(path))),
+			},
+		}
+	}
+	base := runStub(t, flows)
+	for _, path := range []string{"/users/123", "/users/456", "/users/me"} {
+		status, body := stubGet(t, base+path)
+		assert.Equal(t, 200, status, path)
+		assert.Equal(t, path, body)
+	}
+	// 記録されていない値は-fallbackに従う
+	status, _ := stubGet(t, base+"/users/789")
+	assert.Equal(t, 404, status)
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dave/jennifer/jen"
 	"github.com/rs/zerolog/log"
@@ -23,8 +30,97 @@ var (
 	}
 	mockServerPort             = 8080
 	externalAPIToMockServerMap = make(map[string]int)
+	// マッチングに使うリクエストヘッダ名(正規化済み)
+	matchHeaders []string
+	// 同じリクエストに複数のレスポンスがある場合の再生方法(生成コードの-replayフラグのデフォルト値)
+	replayMode = "sequential"
+	// 生成コードで再生位置を管理するためのキー
+	replayKey int
+	useReplay bool
+	// ストリーミングのレスポンスを生成したか
+	useStream bool
+	// 圧縮して返すレスポンスを生成したか
+	useEncode bool
+	// バイナリのボディを生成したか
+	useBinary bool
+	// これより大きいボディはfixturesディレクトリに書き出す(0なら書き出さない)
+	fixtureThreshold int
+	// 書き出すボディ(fixtureDirからの相対パスがキー)
+	fixtures = make(map[string][]byte)
+	// ハッシュで比較するリクエストボディを生成したか
+	useBodyHash bool
+	// SOAPのリクエストの比較方法: body(正規化したボディ) or operation
+	soapMatch = "body"
+	// XMLのリクエストボディを比較するときに除く要素のローカル名
+	ignoreXMLElements []string
+	// パスのIDをテンプレートにするか
+	pathTemplates bool
+	// IDとみなすパスのセグメントのパターン(デフォルトのパターンに追加する)
+	pathParamPatterns []*regexp.Regexp
+	// 記録されていない値のパスに記録された値のパスのレスポンスを返すか
+	anyPathValue bool
+	// テンプレートのパスを生成したか
+	useTemplateRouter bool
+	// マッチしなかったリクエストへの応答(生成コードの-fallbackフラグのデフォルト値): none, 404, 501, nearest or proxy
+	fallbackMode = "none"
+	// ルートごとにマッチしなかったリクエストに返すレスポンス("<メソッド> <パス>"がキー)
+	fallbackResponses map[string]fallbackResponse
+	// リクエストを比較するときに除くJSONのフィールド(parseJSONPathの結果)、クエリパラメータ、ヘッダ
+	ignoreJSONPaths [][]string
+	ignoreQueries   []string
+	ignoreHeaders   []string
+	// 生成コードの-latencyフラグのデフォルト値
+	latencyMode = "off"
+	// WebSocketのメッセージの再生方法(生成コードの-websocketフラグのデフォルト値)
+	webSocketMode = "script"
+	// ツリーを作るときに決まる状態
+	state = newTreeState()
+	// 生成コードのコマンドラインフラグの宣言(フラグ名がキー)
+	generatedFlags = make(map[string]jen.Code)
 )
 
+// ツリーを作るときに記録されたフローから決まり、コードを生成するときに使う状態
+// ツリーを作るたびに作り直すので前に作ったツリーの状態は残らない
+type treeState struct {
+	// ルートごとの記録されたレイテンシ(昇順)
+	routeLatencies map[string][]time.Duration
+	// HTTP/2で通信していた外部API
+	http2Hosts map[string]bool
+	// 圧縮されたリクエストボディを受け取っていたか
+	decodeRequests bool
+	// フォームのリクエストボディを受け取っていたか
+	formRequests bool
+	// XMLのリクエストボディを受け取っていたか
+	xmlRequests bool
+	// brで圧縮されたリクエストやレスポンスを記録していたか(生成コードがbrotliのパッケージを使う)
+	brotli bool
+}
+
+func newTreeState() *treeState {
+	return &treeState{
+		routeLatencies: make(map[string][]time.Duration),
+		http2Hosts:     make(map[string]bool),
+	}
+}
+
+// ツリーとツリーを作るときに決まる状態を初期化する
+// 生成するときに決まる状態はgenerateで初期化する
+func resetTree() {
+	root = &Root{
+		Value:    "",
+		Children: make(map[string]SyntaxNode),
+	}
+	state = newTreeState()
+}
+
+// 大きいボディを書き出すディレクトリ(生成コードからの相対パス)
+const fixtureDir = "fixtures"
+
+// 生成コードでコマンドラインフラグを使う
+func useFlag(name string, decl jen.Code) {
+	generatedFlags[name] = decl
+}
+
 type Node struct {
 	Value    string
 	Children map[string]SyntaxNode
@@ -33,18 +129,52 @@ type Node struct {
 type Root Node
 type Host Node
 type Path Node
+
+// テンプレートのパスに対して記録された実際のパス
+type PathValue Node
 type Method Node
 type QueryParameter Node
-type ReqBody Node
+type RequestHeader Node
+type ReqBody struct {
+	// マッチングのために正規化したボディ
+	Value    string
+	Children map[string]SyntaxNode
+	// 最初に記録されたままのボディとそのContent-Type
+	Body        string
+	ContentType string
+	// 記録された順のレスポンスのキー
+	Sequence []string
+}
 type RespBody struct {
 	Header     http.Header
 	StatusCode int
 	Value      string
 	Children   map[string]SyntaxNode
+	// 外部APIとの通信に失敗した場合のエラーの種類
+	Error string
+	// レイテンシの集計単位(メソッド、ホスト、パス)
+	Route string
+	// 記録されたレスポンスを受け取り終わるまでの時間
+	Latency time.Duration
+	// WebSocketで送受信したメッセージ
+	Messages []WebSocketMessage
+	// ストリーミングのレスポンスを再現するためのチャンク
+	Stream []streamChunk
+	// 記録されたContent-Encoding(ボディは展開済み)
+	Encoding string
+}
+
+type streamChunk struct {
+	// 前のチャンクからの間隔
+	Delay time.Duration
+	Data  string
 }
 
 func (h *Root) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
 	var codes []jen.Code
+	if len(generatedFlags) > 0 {
+		codes = append(codes, jen.Qual("flag", "Parse").Call())
+	}
 	codes = append(codes, *childCodes...)
 	codes = append(codes, generateSignalHandler()...)
 	return []jen.Code{
@@ -69,16 +199,38 @@ func (h *Root) value() string {
 func (h *Host) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
 	var codes []jen.Code
 	codes = append(codes, jen.Id("mux").Op(":=").Qual("net/http", "NewServeMux").Call())
+	mux := "mux"
+	for _, child := range h.Children {
+		if path, ok := child.(*Path); ok && path.isTemplate() {
+			mux = "router"
+		}
+	}
+	if mux == "router" {
+		codes = append(codes, jen.Id("router").Op(":=").Op("&").Id("templateRouter").Values(jen.Dict{jen.Id("mux"): jen.Id("mux")}))
+	}
+	if fallbackMode != "none" {
+		codes = append(codes, jen.Id("upstream").Op(":=").Lit(h.value()))
+	}
 	codes = append(codes, *childCodes...)
+	codes = append(codes, h.renderCatchAll(mux)...)
+	tls := strings.HasPrefix(h.value(), "https")
+	var handler jen.Code = jen.Id("enableLogRequest").Call(jen.Id(mux), jen.Id("port"))
+	if state.http2Hosts[h.value()] && !tls {
+		// 平文のHTTP/2(h2c)
+		handler = jen.Qual("golang.org/x/net/http2/h2c", "NewHandler").Call(handler, jen.Op("&").Qual("golang.org/x/net/http2", "Server").Values())
+	}
 	codes = append(codes,
 		jen.Id("port").Op(":=").Lit(mockServerPort),
 		jen.Id("server").Op(":=").Qual("net/http", "Server").Values(jen.Dict{
 			jen.Id("Addr"):    jen.Lit("0.0.0.0:").Op("+").Qual("fmt", "Sprint").Call(jen.Id("port")),
-			jen.Id("Handler"): jen.Id("enableLogRequest").Call(jen.Id("mux"), jen.Id("port")),
+			jen.Id("Handler"): handler,
 		}),
 		jen.Qual("fmt", "Printf").Call(jen.Lit("Listening on %v\n"), jen.Id("server").Dot("Addr")),
 	)
-	if strings.HasPrefix(h.value(), "https") {
+	if tls {
+		if state.http2Hosts[h.value()] {
+			codes = append(codes, jen.Qual("golang.org/x/net/http2", "ConfigureServer").Call(jen.Op("&").Id("server"), jen.Op("&").Qual("golang.org/x/net/http2", "Server").Values()))
+		}
 		codes = append(codes, jen.Go().Id("server").Dot("ListenAndServeTLS").Call(jen.Lit("cert.pem"), jen.Lit("key.pem")))
 	} else {
 		codes = append(codes, jen.Go().Id("server").Dot("ListenAndServe").Call())
@@ -105,9 +257,42 @@ func (h *Host) value() string {
 }
 
 func (h *ReqBody) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
+	if len(h.Children) <= 1 {
+		return []jen.Code{
+			jen.If(h.matchBody()).Block(*childCodes...),
+		}
+	}
+	// 記録された順にレスポンスを返せるように何回目のリクエストかで分岐する
+	var order []string
+	indexes := make(map[string][]jen.Code)
+	for i, key := range h.Sequence {
+		if _, found := indexes[key]; !found {
+			order = append(order, key)
+		}
+		indexes[key] = append(indexes[key], jen.Lit(i))
+	}
+	var cases []jen.Code
+	for _, key := range order {
+		cases = append(cases, jen.Case(indexes[key]...).Block(generateServerFuncs(h.Children[key], false, false)...))
+	}
+	replayKey++
+	useReplay = true
+	useFlag("replay", jen.Id("replayMode").Op("=").Qual("flag", "String").Call(jen.Lit("replay"), jen.Lit(replayMode), jen.Lit("how to replay multiple responses recorded for the same request: sequential, cycle or random")))
 	return []jen.Code{
-		jen.If(jen.Id("body").Op("==").Lit(h.value())).Block(*childCodes...),
+		jen.If(h.matchBody()).Block(
+			jen.Switch(jen.Id("nextResponse").Call(jen.Lit(fmt.Sprint(replayKey)), jen.Lit(len(h.Sequence)))).Block(cases...),
+		),
+	}
+}
+
+// 大きいボディはリテラルで比較せずハッシュで比較する
+func (h *ReqBody) matchBody() jen.Code {
+	if isLargeBody(h.value()) {
+		useBodyHash = true
+		sum := sha256.Sum256([]byte(h.value()))
+		return jen.Id("hashBody").Call(jen.Id("body")).Op("==").Lit(hex.EncodeToString(sum[:]))
 	}
+	return jen.Id("body").Op("==").Add(bodyString(h.value()))
 }
 
 func (h *ReqBody) children() map[string]SyntaxNode {
@@ -116,6 +301,7 @@ func (h *ReqBody) children() map[string]SyntaxNode {
 
 func (h *ReqBody) addChild(child SyntaxNode) {
 	h.Children[child.value()] = child
+	h.Sequence = append(h.Sequence, child.value())
 }
 
 func (h *ReqBody) value() string {
@@ -123,19 +309,174 @@ func (h *ReqBody) value() string {
 }
 
 func (r *RespBody) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
+	if r.Error != "" {
+		return r.renderError()
+	}
+	if r.StatusCode == http.StatusSwitchingProtocols {
+		return r.renderWebSocket()
+	}
 	var codes []jen.Code
+	if r.Latency > 0 {
+		useLatency()
+		codes = append(codes, jen.Id("delay").Call(jen.Lit(r.Route), durationLit(r.Latency)))
+	}
 	for k, vv := range r.Header {
 		for _, v := range vv {
 			codes = append(codes, jen.Id("rw").Dot("Header").Call().Dot("Set").Call(jen.Lit(k), jen.Lit(v)))
 		}
 	}
+	if r.Encoding != "" && len(r.Stream) == 0 {
+		// クライアントのAccept-Encodingに合わせて圧縮し直す
+		useEncode = true
+		return append(codes, []jen.Code{
+			jen.Id("writeEncoded").Call(jen.Id("rw"), jen.Id("r"), jen.Lit(r.StatusCode), jen.Lit(r.Encoding), bodyString(r.Value)),
+			jen.Return(),
+		}...)
+	}
+	codes = append(codes, jen.Id("rw").Dot("WriteHeader").Call(jen.Lit(r.StatusCode)))
+	if len(r.Stream) > 0 {
+		return append(codes, r.renderStream(), jen.Return())
+	}
+	if isLargeBody(r.Value) {
+		return append(codes, []jen.Code{
+			jen.Id("rw").Dot("Write").Call(fixture(r.Value)),
+			jen.Return(),
+		}...)
+	}
+	if isBinaryBody(r.Value) {
+		useBinary = true
+		return append(codes, []jen.Code{
+			jen.Id("rw").Dot("Write").Call(jen.Id("binaryBody").Call(jen.Lit(base64.StdEncoding.EncodeToString([]byte(r.Value))))),
+			jen.Return(),
+		}...)
+	}
 	return append(codes, []jen.Code{
-		jen.Id("rw").Dot("WriteHeader").Call(jen.Lit(r.StatusCode)),
 		jen.Qual("fmt", "Fprint").Call(jen.Id("rw"), jen.Lit(r.Value)),
 		jen.Return(),
 	}...)
 }
 
+func isLargeBody(value string) bool {
+	return fixtureThreshold > 0 && len(value) > fixtureThreshold
+}
+
+// ボディをfixturesディレクトリに書き出し、go:embedで読み込むコードを返す
+// 同じ内容のボディは同じファイルになる
+func fixture(value string) jen.Code {
+	sum := sha256.Sum256([]byte(value))
+	name := hex.EncodeToString(sum[:16])
+	switch {
+	case json.Valid([]byte(value)):
+		name += ".json"
+	case isBinaryBody(value):
+		name += ".bin"
+	default:
+		name += ".txt"
+	}
+	fixtures[name] = []byte(value)
+	return jen.Id("fixture").Call(jen.Lit(name))
+}
+
+// バイナリのボディは文字列リテラルにすると読めないのでbase64で埋め込む
+func bodyString(value string) jen.Code {
+	if isLargeBody(value) {
+		return jen.String().Call(fixture(value))
+	}
+	if !isBinaryBody(value) {
+		return jen.Lit(value)
+	}
+	useBinary = true
+	return jen.String().Call(jen.Id("binaryBody").Call(jen.Lit(base64.StdEncoding.EncodeToString([]byte(value)))))
+}
+
+// 記録された間隔でチャンクごとにフラッシュする
+func (r *RespBody) renderStream() jen.Code {
+	useStream = true
+	return jen.Id("streamChunks").Call(jen.Id("rw"), jen.Index().Id("streamChunk").ValuesFunc(func(g *jen.Group) {
+		for _, c := range r.Stream {
+			g.Line().Values(jen.Dict{
+				jen.Id("Delay"): durationLit(c.Delay),
+				jen.Id("Data"):  jen.Lit(c.Data),
+			})
+		}
+		g.Line()
+	}))
+}
+
+// off, recordedまたはp50のようなパーセンタイルを受け付ける
+func isLatencyMode(mode string) bool {
+	switch mode {
+	case "off", "recorded":
+		return true
+	}
+	if !strings.HasPrefix(mode, "p") {
+		return false
+	}
+	p, err := strconv.ParseFloat(mode[1:], 64)
+	return err == nil && p > 0 && p <= 100
+}
+
+func useLatency() {
+	useFlag("latency", jen.Id("latencyMode").Op("=").Qual("flag", "String").Call(jen.Lit("latency"), jen.Lit(latencyMode), jen.Lit("reproduce recorded upstream latency: off, recorded or a percentile of the route such as p50, p95")))
+}
+
+// 読みやすいようにミリ秒単位で出力する
+func durationLit(d time.Duration) jen.Code {
+	return jen.Lit(int(d.Milliseconds())).Op("*").Qual("time", "Millisecond")
+}
+
+// アップグレードして記録されたメッセージを再生する
+func (r *RespBody) renderWebSocket() []jen.Code {
+	useFlag("websocket", jen.Id("webSocketMode").Op("=").Qual("flag", "String").Call(jen.Lit("websocket"), jen.Lit(webSocketMode), jen.Lit("how to replay websocket messages: script(in the recorded order) or keyed(reply to the same client message)")))
+	messages := make([]jen.Code, 0, len(r.Messages))
+	for _, m := range r.Messages {
+		fields := jen.Dict{
+			jen.Id("Data"): jen.Lit(string(m.Data)),
+		}
+		if m.From == webSocketFromClient {
+			fields[jen.Id("FromClient")] = jen.True()
+		}
+		if m.Binary {
+			fields[jen.Id("Binary")] = jen.True()
+		}
+		messages = append(messages, jen.Values(fields))
+	}
+	return []jen.Code{
+		jen.Id("serveWebSocket").Call(jen.Id("rw"), jen.Id("r"), jen.Index().Id("webSocketMessage").ValuesFunc(func(g *jen.Group) {
+			for _, m := range messages {
+				g.Line().Add(m)
+			}
+			if len(messages) > 0 {
+				g.Line()
+			}
+		})),
+		jen.Return(),
+	}
+}
+
+// 外部APIとの通信の失敗を再現する
+func (r *RespBody) renderError() []jen.Code {
+	switch r.Error {
+	case upstreamErrorTimeout:
+		useFlag("timeoutDelay", jen.Id("timeoutDelay").Op("=").Qual("flag", "Duration").Call(jen.Lit("timeoutDelay"), jen.Qual("time", "Minute"), jen.Lit("delay before closing the connection for requests whose upstream timed out")))
+		return []jen.Code{
+			jen.Qual("time", "Sleep").Call(jen.Op("*").Id("timeoutDelay")),
+			jen.Panic(jen.Qual("net/http", "ErrAbortHandler")),
+		}
+	case upstreamErrorRefused, upstreamErrorTLS:
+		// レスポンスを返さずにコネクションを閉じる
+		return []jen.Code{
+			jen.Panic(jen.Qual("net/http", "ErrAbortHandler")),
+		}
+	default:
+		// 名前解決の失敗などはプロキシと同様に502を返す
+		return []jen.Code{
+			jen.Id("rw").Dot("WriteHeader").Call(jen.Qual("net/http", "StatusBadGateway")),
+			jen.Return(),
+		}
+	}
+}
+
 func (h *RespBody) children() map[string]SyntaxNode {
 	return h.Children
 }
@@ -168,14 +509,30 @@ func (h *QueryParameter) value() string {
 	return h.Value
 }
 
+func (h *RequestHeader) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
+	return []jen.Code{
+		jen.If(jen.List(jen.Id("h"), jen.Id("_")).Op(":=").Id("stringifySelectedHeader").Call(jen.Id("r").Dot("Header"), jen.Id("matchHeaders")), jen.Id("h").Op("==").Lit(h.value())).Block(
+			*childCodes...,
+		),
+	}
+}
+
+func (h *RequestHeader) children() map[string]SyntaxNode {
+	return h.Children
+}
+
+func (h *RequestHeader) addChild(child SyntaxNode) {
+	h.Children[child.value()] = child
+}
+
+func (h *RequestHeader) value() string {
+	return h.Value
+}
+
 func (h *Method) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
-	var codes []jen.Code
-	if isFirst {
-		codes = append(codes,
-			jen.List(jen.Id("body"), jen.Id("_")).Op(":=").Id("stringify").Call(jen.Id("r").Dot("Body")),
-		)
+	return []jen.Code{
+		jen.If(jen.Id("r").Dot("Method").Op("==").Lit(h.value())).Block(*childCodes...),
 	}
-	return append(codes, jen.If(jen.Id("r").Dot("Method").Op("==").Lit(h.value())).Block(*childCodes...))
 }
 
 func (h *Method) children() map[string]SyntaxNode {
@@ -191,13 +548,108 @@ func (h *Method) value() string {
 }
 
 func (h *Path) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
+	codes := readRequestBody()
+	mux := "mux"
+	if h.isTemplate() {
+		useTemplateRouter = true
+		mux = "router"
+	}
+	if h.hasPathValues() && anyPathValue {
+		// 記録されていない値のパスは辞書順で最初に記録された値のパスとして扱う
+		recorded := []jen.Code{jen.Id("r").Dot("URL").Dot("Path")}
+		for _, key := range sortedKeys(h.Children) {
+			recorded = append(recorded, jen.Lit(key))
+		}
+		codes = append(codes, jen.Id("path").Op(":=").Id("recordedPath").Call(recorded...))
+	}
+	codes = append(codes, *childCodes...)
+	codes = append(codes, h.renderFallback(mux)...)
 	return []jen.Code{
-		jen.Id("mux").Dot("HandleFunc").Call(jen.Lit(h.value()), jen.Func().Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Add(jen.Op("*")).Qual("net/http", "Request")).Block(
-			*childCodes...,
+		jen.Id(mux).Dot("HandleFunc").Call(jen.Lit(h.value()), jen.Func().Params(jen.Id("rw").Qual("net/http", "ResponseWriter"), jen.Id("r").Add(jen.Op("*")).Qual("net/http", "Request")).Block(
+			codes...,
 		)),
 	}
 }
 
+// パラメータを含むテンプレートのパスか
+func (h *Path) isTemplate() bool {
+	return h.hasPathValues() || isTemplatePath(h.Value)
+}
+
+// 記録された値のパスごとにレスポンスを返すか
+func (h *Path) hasPathValues() bool {
+	for _, child := range h.Children {
+		if _, ok := child.(*PathValue); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// リクエストボディを比較できる形にする
+func readRequestBody() []jen.Code {
+	reqBody := jen.Id("r").Dot("Body")
+	if state.decodeRequests {
+		reqBody = jen.Id("decodeBody").Call(jen.Id("r"))
+	}
+	var codes []jen.Code
+	if fallbackMode != "none" {
+		// 外部APIに転送できるようにボディを読み直せるようにする
+		codes = append(codes, jen.Id("keepBody").Call(jen.Id("r")))
+	}
+	codes = append(codes, jen.List(jen.Id("body"), jen.Id("_")).Op(":=").Id("stringify").Call(reqBody))
+	if state.formRequests {
+		codes = append(codes,
+			jen.Id("body").Op("=").Id("stringifyForm").Call(jen.Id("r").Dot("Header").Dot("Get").Call(jen.Lit("Content-Type")), jen.Id("body")),
+		)
+	}
+	if state.xmlRequests {
+		codes = append(codes,
+			jen.Id("body").Op("=").Id("stringifyXML").Call(jen.Id("r").Dot("Header"), jen.Id("body")),
+		)
+	}
+	if len(ignoreJSONPaths) > 0 {
+		codes = append(codes,
+			jen.Id("body").Op("=").Id("ignoreJSONFields").Call(jen.Id("body")),
+		)
+	}
+	if fallbackMode != "none" {
+		// 最も近いリクエストとして再度ハンドラに渡されたときはそのボディで比較する
+		codes = append(codes,
+			jen.If(jen.List(jen.Id("c"), jen.Id("ok")).Op(":=").Id("r").Dot("Context").Call().Dot("Value").Call(jen.Id("fallbackKey").Values()).Assert(jen.Id("fallbackCandidate")), jen.Id("ok")).Block(
+				jen.Id("body").Op("=").Id("c").Dot("Body"),
+			),
+		)
+	}
+	return codes
+}
+
+func (h *PathValue) render(childCodes *[]jen.Code, isFirst, isLast bool) []jen.Code {
+	return []jen.Code{
+		jen.If(h.pathValue().Op("==").Lit(h.value())).Block(*childCodes...),
+	}
+}
+
+// 記録されていない値はマッチせずにフォールバックする
+func (h *PathValue) pathValue() *jen.Statement {
+	if anyPathValue {
+		return jen.Id("path")
+	}
+	return jen.Id("r").Dot("URL").Dot("Path")
+}
+
+func (h *PathValue) children() map[string]SyntaxNode {
+	return h.Children
+}
+
+func (h *PathValue) addChild(child SyntaxNode) {
+	h.Children[child.value()] = child
+}
+
+func (h *PathValue) value() string {
+	return h.Value
+}
+
 func (h *Path) children() map[string]SyntaxNode {
 	return h.Children
 }
@@ -211,10 +663,21 @@ func (h *Path) value() string {
 }
 
 func createResponseKey(r *RespBody) string {
+	if r.Error != "" {
+		return "error-" + r.Error
+	}
 	header, err := stringifyHeader(r.Header)
 	if err != nil {
 		// 失敗しても最低限のコード生成は可能なので続行する
 		log.Error().Err(err)
 	}
+	if len(r.Messages) > 0 {
+		// 送受信したメッセージが異なれば別のレスポンスとして扱う
+		var script strings.Builder
+		for _, m := range r.Messages {
+			fmt.Fprintf(&script, "%s:%t:%q,", m.From, m.Binary, m.Data)
+		}
+		return fmt.Sprintf("%d-%s-%s-%s", r.StatusCode, header, r.Value, script.String())
+	}
 	return fmt.Sprintf("%d-%s-%s", r.StatusCode, header, r.Value)
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// WebSocketMessage is a data message sent over an upgraded WebSocket connection.
+type WebSocketMessage struct {
+	// フローの開始からの経過時間
+	At time.Duration `json:"at"`
+	// "client" or "server"
+	From   string `json:"from"`
+	Binary bool   `json:"binary,omitempty"`
+	Data   []byte `json:"data"`
+}
+
+const (
+	webSocketFromClient = "client"
+	webSocketFromServer = "server"
+)
+
+// WebSocket (RFC 6455)のopcode
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+
+	// 壊れたフレームで巨大なバッファを確保しないための上限
+	wsMaxPayload = 64 << 20
+)
+
+func isWebSocketRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// goproxyはWebSocketのフレームを記録できないので、アップグレードは自前で中継する
+func (p *GenProxy) serveWebSocket(rw http.ResponseWriter, r *http.Request) {
+	// 圧縮されるとフレームの中身を記録できないので拡張はネゴシエートさせない
+	r.Header.Del("Sec-WebSocket-Extensions")
+	flow := p.begin(r)
+	upstream, err := p.dialWebSocket(r)
+	if err != nil {
+		p.fail(flow, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	r.RequestURI = ""
+	r.Header = recordedHeader(r.Header)
+	if err := r.Write(upstream); err != nil {
+		p.fail(flow, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	upstreamReader := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamReader, r)
+	if err != nil {
+		p.fail(flow, err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	flow.Wait = time.Since(flow.StartedAt)
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		p.fail(flow, fmt.Errorf("websocket upgrade is not supported on %s", r.Proto))
+		http.Error(rw, "websocket upgrade is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		p.fail(flow, err)
+		return
+	}
+	defer client.Close()
+
+	respBody := readAllBody(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err := resp.Write(client); err != nil {
+		log.Warn().Err(err).Msg("failed to write websocket handshake response")
+	}
+	flow.Response = http.Response{
+		StatusCode: resp.StatusCode,
+		Proto:      resp.Proto,
+		Header:     resp.Header,
+		Body:       io.NopCloser(bytes.NewReader(respBody)),
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		p.complete(flow)
+		return
+	}
+	log.Info().Msgf("%s %s (websocket)", flow.Request.Method, flow.Request.URL.String())
+
+	recorder := &webSocketRecorder{startedAt: flow.StartedAt}
+	done := make(chan struct{}, 2)
+	relay := func(dst io.Writer, src io.Reader, from string) {
+		recorder.relay(dst, src, from)
+		done <- struct{}{}
+	}
+	go relay(upstream, clientBuf, webSocketFromClient)
+	go relay(client, upstreamReader, webSocketFromServer)
+	// どちらかが切断したら両方閉じる
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+	flow.Messages = recorder.messages
+	p.complete(flow)
+}
+
+// ReverseProxyでアップグレードした場合の101のボディ(外部APIとのコネクション)を
+// 中継しながらメッセージを記録し、切断されたらフローを完了する
+func (p *GenProxy) recordWebSocket(flow Flow, conn io.ReadWriteCloser) io.ReadWriteCloser {
+	clientReader, clientWriter := io.Pipe()
+	serverReader, serverWriter := io.Pipe()
+	recorder := &webSocketRecorder{startedAt: flow.StartedAt}
+	done := make(chan struct{}, 2)
+	go func() {
+		recorder.relay(conn, clientReader, webSocketFromClient)
+		done <- struct{}{}
+	}()
+	go func() {
+		recorder.relay(serverWriter, conn, webSocketFromServer)
+		done <- struct{}{}
+	}()
+	go func() {
+		<-done
+		conn.Close()
+		clientReader.Close()
+		serverWriter.Close()
+		<-done
+		flow.Messages = recorder.messages
+		p.complete(flow)
+	}()
+	log.Info().Msgf("%s %s (websocket)", flow.Request.Method, flow.Request.URL.String())
+	return &upgradedConn{
+		Reader: serverReader,
+		Writer: clientWriter,
+		close: func() error {
+			clientWriter.Close()
+			serverReader.Close()
+			return conn.Close()
+		},
+	}
+}
+
+type upgradedConn struct {
+	io.Reader
+	io.Writer
+	close func() error
+}
+
+func (c *upgradedConn) Close() error {
+	return c.close()
+}
+
+func (p *GenProxy) dialWebSocket(r *http.Request) (net.Conn, error) {
+	host := r.URL.Host
+	secure := r.URL.Scheme == "https" || r.URL.Scheme == "wss"
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	if !secure {
+		return net.Dial("tcp", host)
+	}
+	config := &tls.Config{}
+	if p.proxy.Tr.TLSClientConfig != nil {
+		config = p.proxy.Tr.TLSClientConfig.Clone()
+	}
+	config.ServerName = r.URL.Hostname()
+	// アップグレードはHTTP/1.1でしか行えない
+	config.NextProtos = []string{"http/1.1"}
+	return tls.Dial("tcp", host, config)
+}
+
+type webSocketRecorder struct {
+	startedAt time.Time
+	mutex     sync.Mutex
+	messages  []WebSocketMessage
+}
+
+func (w *webSocketRecorder) add(m WebSocketMessage) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.messages = append(w.messages, m)
+}
+
+// フレームをそのまま中継しながらデータメッセージを記録する
+func (w *webSocketRecorder) relay(dst io.Writer, src io.Reader, from string) {
+	var message *WebSocketMessage
+	for {
+		frame, err := readWebSocketFrame(src)
+		if err != nil {
+			return
+		}
+		if _, err := dst.Write(frame.raw); err != nil {
+			return
+		}
+		switch frame.opcode {
+		case wsOpText, wsOpBinary:
+			message = &WebSocketMessage{
+				From:   from,
+				Binary: frame.opcode == wsOpBinary,
+				Data:   frame.payload,
+			}
+		case wsOpContinuation:
+			if message != nil {
+				message.Data = append(message.Data, frame.payload...)
+			}
+		default:
+			// 制御フレーム(ping/pong/close)は記録しない
+			continue
+		}
+		if frame.fin && message != nil {
+			message.At = time.Since(w.startedAt)
+			w.add(*message)
+			message = nil
+		}
+	}
+}
+
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+	// 中継するための受信したままのバイト列
+	raw []byte
+}
+
+func readWebSocketFrame(r io.Reader) (webSocketFrame, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return webSocketFrame{}, err
+	}
+	frame := webSocketFrame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0f,
+	}
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	var extended int
+	switch length {
+	case 126:
+		extended = 2
+	case 127:
+		extended = 8
+	}
+	if masked {
+		extended += 4
+	}
+	header = header[:2+extended]
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return webSocketFrame{}, err
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:10])
+	}
+	if length > wsMaxPayload {
+		return webSocketFrame{}, fmt.Errorf("too large websocket frame: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return webSocketFrame{}, err
+	}
+	frame.raw = append(header, payload...)
+	if masked {
+		key := header[len(header)-4:]
+		unmasked := make([]byte, len(payload))
+		for i := range payload {
+			unmasked[i] = payload[i] ^ key[i%4]
+		}
+		payload = unmasked
+	}
+	frame.payload = payload
+	return frame, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func newWebSocketServer() *httptest.Server {
+	return httptest.NewServer(websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			websocket.Message.Send(ws, "welcome")
+			for {
+				var msg string
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+				websocket.Message.Send(ws, "echo:"+msg)
+			}
+		},
+	})
+}
+
+// 記録が完了するのはコネクションが閉じられた後
+func waitWebSocketFlow(t *testing.T, p *GenProxy) Flow {
+	var flow Flow
+	assert.Eventually(t, func() bool {
+		p.flows.mutex.Lock()
+		defer p.flows.mutex.Unlock()
+		for _, f := range p.flows.Flows {
+			flow = f
+		}
+		return len(flow.Messages) == 3
+	}, time.Second, 10*time.Millisecond)
+	return flow
+}
+
+func assertWebSocketMessages(t *testing.T, flow Flow) {
+	assert.Equal(t, http.StatusSwitchingProtocols, flow.Response.StatusCode)
+	assert.Equal(t, []string{webSocketFromServer, webSocketFromClient, webSocketFromServer}, []string{flow.Messages[0].From, flow.Messages[1].From, flow.Messages[2].From})
+	assert.Equal(t, "welcome", string(flow.Messages[0].Data))
+	assert.Equal(t, "hello", string(flow.Messages[1].Data))
+	assert.Equal(t, "echo:hello", string(flow.Messages[2].Data))
+	assert.True(t, flow.Messages[0].At <= flow.Messages[2].At)
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	es := newWebSocketServer()
+	defer es.Close()
+	p := NewGenProxy()
+	pserver := httptest.NewServer(p)
+	defer pserver.Close()
+
+	conn, err := net.Dial("tcp", pserver.Listener.Addr().String())
+	assert.NoError(t, err)
+	// プロキシ宛てなので絶対URLでアップグレードする
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", es.URL, es.Listener.Addr())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	frame, err := readWebSocketFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "welcome", string(frame.payload))
+	// クライアントからのフレームはマスクする
+	payload := []byte("hello")
+	key := []byte{1, 2, 3, 4}
+	masked := []byte{0x80 | wsOpText, 0x80 | byte(len(payload))}
+	masked = append(masked, key...)
+	for i, b := range payload {
+		masked = append(masked, b^key[i%4])
+	}
+	_, err = conn.Write(masked)
+	assert.NoError(t, err)
+	frame, err = readWebSocketFrame(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo:hello", string(frame.payload))
+	conn.Close()
+
+	assertWebSocketMessages(t, waitWebSocketFlow(t, p))
+}
+
+func TestReverseProxyWebSocket(t *testing.T) {
+	es := newWebSocketServer()
+	defer es.Close()
+	upstream, _ := url.Parse(es.URL)
+	p := NewGenProxy()
+	rserver := httptest.NewServer(p.ReverseProxy(upstream))
+	defer rserver.Close()
+
+	ws, err := websocket.Dial("ws://"+rserver.Listener.Addr().String()+"/ws", "", rserver.URL)
+	assert.NoError(t, err)
+	var msg string
+	assert.NoError(t, websocket.Message.Receive(ws, &msg))
+	assert.NoError(t, websocket.Message.Send(ws, "hello"))
+	assert.NoError(t, websocket.Message.Receive(ws, &msg))
+	assert.Equal(t, "echo:hello", msg)
+	ws.Close()
+
+	assertWebSocketMessages(t, waitWebSocketFlow(t, p))
+}
+
+func TestReadWebSocketFrame(t *testing.T) {
+	// 126バイト以上は拡張ペイロード長になる
+	payload := make([]byte, 300)
+	raw := append([]byte{wsOpBinary, 126, 0x01, 0x2c}, payload...)
+	frame, err := readWebSocketFrame(bytes.NewReader(raw))
+	assert.NoError(t, err)
+	assert.False(t, frame.fin)
+	assert.Equal(t, byte(wsOpBinary), frame.opcode)
+	assert.Equal(t, 300, len(frame.payload))
+	assert.Equal(t, raw, frame.raw)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+func isXMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// XMLのボディを空白や属性の順序、名前空間のプレフィックスに依らない文字列にする
+// SOAPの場合はsoapMatchに従ってオペレーションだけで比較することもできる
+func normalizeXML(header http.Header, body string) (string, bool) {
+	if !isXMLContentType(header.Get("Content-Type")) {
+		return body, false
+	}
+	if soapMatch == "operation" {
+		if op := soapOperation(header, body); op != "" {
+			return "operation:" + op, true
+		}
+	}
+	canonical, err := canonicalXML(body, ignoreXMLElements)
+	if err != nil {
+		return body, false
+	}
+	return canonical, true
+}
+
+// C14Nに近い正規化を行う
+// 要素と属性は名前空間のURIで表し、属性はソートし、空白だけのテキストやコメントは除く
+// ignoreに含まれるローカル名の要素は子要素ごと除く
+func canonicalXML(body string, ignore []string) (string, error) {
+	ignored := make(map[string]bool)
+	for _, name := range ignore {
+		ignored[name] = true
+	}
+	d := xml.NewDecoder(strings.NewReader(body))
+	var buf strings.Builder
+	skip := 0
+	found := false
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if skip > 0 || ignored[t.Name.Local] {
+				skip++
+				continue
+			}
+			attrs := make([]string, 0, len(t.Attr))
+			for _, a := range t.Attr {
+				// 名前空間の宣言はプレフィックスが変わるだけなので比較しない
+				if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+					continue
+				}
+				attrs = append(attrs, fmt.Sprintf(" {%s}%s=%q", a.Name.Space, a.Name.Local, a.Value))
+			}
+			sort.Strings(attrs)
+			found = true
+			fmt.Fprintf(&buf, "<{%s}%s%s>", t.Name.Space, t.Name.Local, strings.Join(attrs, ""))
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			fmt.Fprintf(&buf, "</{%s}%s>", t.Name.Space, t.Name.Local)
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			if text := strings.TrimSpace(string(t)); text != "" {
+				xml.EscapeText(&buf, []byte(text))
+			}
+		}
+	}
+	if !found {
+		return body, fmt.Errorf("no XML element found")
+	}
+	return buf.String(), nil
+}
+
+// SOAPActionヘッダ(SOAP 1.2ではContent-Typeのaction)またはBodyの最初の要素をオペレーションとする
+func soapOperation(header http.Header, body string) string {
+	if action := strings.Trim(header.Get("SOAPAction"), `"`); action != "" {
+		return action
+	}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && params["action"] != "" {
+		return params["action"]
+	}
+	d := xml.NewDecoder(strings.NewReader(body))
+	inBody := false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			if inBody {
+				return fmt.Sprintf("{%s}%s", se.Name.Space, se.Name.Local)
+			}
+			inBody = se.Name.Local == "Body"
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalXML(t *testing.T) {
+	a := `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:m="urn:stock">
+  <soap:Header><m:MessageID>uuid-1</m:MessageID></soap:Header>
+  <soap:Body>
+    <m:GetPrice currency="JPY" market="tse"><m:Code>7203</m:Code></m:GetPrice>
+  </soap:Body>
+</soap:Envelope>`
+	b := `<env:Envelope xmlns:env="http://schemas.xmlsoap.org/soap/envelope/"><env:Header><MessageID xmlns="urn:stock">uuid-2</MessageID></env:Header><env:Body><GetPrice xmlns="urn:stock" market="tse" currency="JPY"><Code> 7203 </Code></GetPrice></env:Body></env:Envelope>`
+
+	ca, err := canonicalXML(a, []string{"MessageID"})
+	assert.NoError(t, err)
+	cb, err := canonicalXML(b, []string{"MessageID"})
+	assert.NoError(t, err)
+	assert.Equal(t, `<{http://schemas.xmlsoap.org/soap/envelope/}Envelope><{http://schemas.xmlsoap.org/soap/envelope/}Header></{http://schemas.xmlsoap.org/soap/envelope/}Header><{http://schemas.xmlsoap.org/soap/envelope/}Body><{urn:stock}GetPrice {}currency="JPY" {}market="tse"><{urn:stock}Code>7203</{urn:stock}Code></{urn:stock}GetPrice></{http://schemas.xmlsoap.org/soap/envelope/}Body></{http://schemas.xmlsoap.org/soap/envelope/}Envelope>`, ca)
+	assert.Equal(t, ca, cb)
+
+	// 除かなければMessageIDの違いで一致しない
+	ca, _ = canonicalXML(a, nil)
+	cb, _ = canonicalXML(b, nil)
+	assert.NotEqual(t, ca, cb)
+
+	_, err = canonicalXML("not xml", nil)
+	assert.Error(t, err)
+
+	assert.Equal(t, "{urn:stock}GetPrice", soapOperation(http.Header{}, a))
+	assert.Equal(t, "urn:stock#GetPrice", soapOperation(http.Header{"Soapaction": []string{`"urn:stock#GetPrice"`}}, a))
+	assert.Equal(t, "urn:GetPrice", soapOperation(http.Header{"Content-Type": []string{`application/soap+xml; charset=utf-8; action="urn:GetPrice"`}}, a))
+}